@@ -0,0 +1,55 @@
+package artifacts
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Writer writes sensitive cluster artifacts such as talosconfig and kubeconfig to a local directory
+type Writer struct {
+	ctx     *pulumi.Context
+	dir     string
+	written pulumi.StringMap
+}
+
+func NewWriter(ctx *pulumi.Context, dir string) *Writer {
+	return &Writer{ctx: ctx, dir: dir, written: pulumi.StringMap{}}
+}
+
+// Write schedules content to be written to name within the artifacts directory once it is known.
+// Nothing is written during preview. The file is only readable by the current user.
+func (w *Writer) Write(name string, content pulumi.StringOutput) {
+	path := filepath.Join(w.dir, name)
+	written := content.ApplyT(func(c string) (string, error) {
+		if w.ctx.DryRun() {
+			return path, nil
+		}
+
+		err := os.MkdirAll(w.dir, 0700)
+		if err != nil {
+			return "", fmt.Errorf("failed to create artifacts directory %s: %w", w.dir, err)
+		}
+		err = os.WriteFile(path, []byte(c), 0600)
+		if err != nil {
+			return "", fmt.Errorf("failed to write artifact %s: %w", path, err)
+		}
+		// WriteFile keeps the mode of existing files, so files written by older versions have to be fixed up
+		err = os.Chmod(path, 0600)
+		if err != nil {
+			return "", fmt.Errorf("failed to restrict permissions of artifact %s: %w", path, err)
+		}
+
+		return path, nil
+	}).(pulumi.StringOutput)
+	// The path itself isn't sensitive, only the content is
+	w.written[name] = pulumi.Unsecret(written).(pulumi.StringOutput)
+}
+
+// Paths returns the paths of all written artifacts keyed by name. It has to be exported,
+// otherwise write errors wouldn't fail the update.
+func (w *Writer) Paths() pulumi.StringMapOutput {
+	return w.written.ToStringMapOutput()
+}
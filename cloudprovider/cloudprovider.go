@@ -0,0 +1,159 @@
+package cloudprovider
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"talos-azure/helpers"
+	"talos-azure/identity"
+	"text/template"
+
+	"github.com/pulumi/pulumi-azure-native-sdk/resources/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	ccmVersion          = "v1.30.4"
+	azureDiskCsiVersion = "v1.30.3"
+	// cloudConfigSecret is where both the cloud controller manager and the CSI driver read azure.json from
+	cloudConfigSecret = "azure-cloud-provider"
+)
+
+//go:embed manifests/cloud-controller-manager.yaml
+var ccmManifest string
+
+// azureDiskCsiManifests are applied by Talos from upstream, the driver reads its config from cloudConfigSecret
+var azureDiskCsiManifests = []string{
+	"rbac-csi-azuredisk-controller.yaml",
+	"rbac-csi-azuredisk-node.yaml",
+	"csi-azuredisk-driver.yaml",
+	"csi-azuredisk-controller.yaml",
+	"csi-azuredisk-node.yaml",
+}
+
+type ConfigPatchParams struct {
+	ResourceGroup *resources.ResourceGroup
+	Identity      Identity
+	VnetName      pulumi.StringOutput
+	NsgName       pulumi.StringOutput
+	// SubnetId is the subnet the cloud controller manager places internal load balancers into
+	SubnetId pulumi.StringPtrOutput
+}
+
+// ConfigPatch returns the Talos config patch which switches the cluster to the external Azure cloud provider
+// and installs the cloud controller manager, the cloud node manager and the Azure Disk CSI driver.
+func ConfigPatch(ctx *pulumi.Context, params ConfigPatchParams) (pulumi.StringOutput, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	manifest, err := renderCcmManifest(conf.ClusterName)
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+	csiManifests := make([]string, len(azureDiskCsiManifests))
+	for i, name := range azureDiskCsiManifests {
+		csiManifests[i] = fmt.Sprintf("https://raw.githubusercontent.com/kubernetes-sigs/azuredisk-csi-driver/%s/deploy/%s/%s", azureDiskCsiVersion, azureDiskCsiVersion, name)
+	}
+
+	return cloudConfig(conf, params).ApplyT(func(cloudCfg string) (string, error) {
+		secret, err := json.Marshal(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   map[string]string{"name": cloudConfigSecret, "namespace": "kube-system"},
+			"stringData": map[string]string{"cloud-config": cloudCfg},
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to build cloud config secret: %w", err)
+		}
+		// JSON is valid YAML, so the result is accepted as a strategic merge patch
+		patch, err := json.Marshal(map[string]interface{}{
+			"cluster": map[string]interface{}{
+				"externalCloudProvider": map[string]interface{}{
+					"enabled":   true,
+					"manifests": csiManifests,
+				},
+				"inlineManifests": []map[string]string{
+					{"name": cloudConfigSecret, "contents": string(secret)},
+					{"name": "azure-cloud-controller-manager", "contents": manifest},
+				},
+			},
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to build cloud provider config patch: %w", err)
+		}
+		return string(patch), nil
+	}).(pulumi.StringOutput), nil
+}
+
+// cloudConfig builds the azure.json of the cloud provider. Routes aren't managed by the cloud provider,
+// so no route table is configured.
+func cloudConfig(conf helpers.CustomConfig, params ConfigPatchParams) pulumi.StringOutput {
+	vnetResourceGroup := params.ResourceGroup.Name
+	if conf.ExistingSubnet != nil {
+		vnetResourceGroup = pulumi.String(conf.ExistingSubnet.ResourceGroupName).ToStringOutput()
+	}
+	// vmssflex also handles standalone VMs, standard only knows about those
+	vmType := "standard"
+	for _, pool := range conf.NodePools {
+		if pool.ScaleSet {
+			vmType = "vmssflex"
+		}
+	}
+
+	return pulumi.All(
+		params.Identity.TenantId,
+		identity.SubscriptionId(params.ResourceGroup),
+		params.ResourceGroup.Name,
+		params.VnetName,
+		vnetResourceGroup,
+		params.SubnetId,
+		params.NsgName,
+		params.Identity.ClientId,
+	).ApplyT(func(args []interface{}) (string, error) {
+		subnetId := *args[5].(*string)
+		cfg, err := json.MarshalIndent(map[string]interface{}{
+			"cloud":                        "AzurePublicCloud",
+			"tenantId":                     args[0].(string),
+			"subscriptionId":               args[1].(string),
+			"resourceGroup":                args[2].(string),
+			"location":                     conf.AzRegion,
+			"vnetName":                     args[3].(string),
+			"vnetResourceGroup":            args[4].(string),
+			"subnetName":                   subnetId[strings.LastIndex(subnetId, "/")+1:],
+			"securityGroupName":            args[6].(string),
+			"securityGroupResourceGroup":   args[2].(string),
+			"routeTableName":               "",
+			"vmType":                       vmType,
+			"loadBalancerSku":              "standard",
+			"useManagedIdentityExtension":  true,
+			"userAssignedIdentityID":       args[7].(string),
+			"useInstanceMetadata":          true,
+			"disableOutboundSNAT":          true,
+			"cloudProviderBackoff":         true,
+			"cloudProviderRateLimit":       true,
+			"cloudProviderRateLimitQPS":    10,
+			"cloudProviderRateLimitBucket": 100,
+		}, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("failed to build azure cloud config: %w", err)
+		}
+		return string(cfg), nil
+	}).(pulumi.StringOutput)
+}
+
+func renderCcmManifest(clusterName string) (string, error) {
+	tmpl, err := template.New("ccm").Parse(ccmManifest)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse cloud controller manager manifest: %w", err)
+	}
+	var manifest bytes.Buffer
+	err = tmpl.Execute(&manifest, map[string]string{"Version": ccmVersion, "ClusterName": clusterName})
+	if err != nil {
+		return "", fmt.Errorf("failed to render cloud controller manager manifest: %w", err)
+	}
+	return manifest.String(), nil
+}
@@ -0,0 +1,69 @@
+package cloudprovider
+
+import (
+	"fmt"
+	"talos-azure/helpers"
+	"talos-azure/identity"
+
+	"github.com/pulumi/pulumi-azure-native-sdk/authorization/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/resources/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Built-in Azure role definition ids
+const (
+	contributorRoleId        = "b24988ac-6181-42a0-ab88-20f7382dd24c"
+	networkContributorRoleId = "4d97b98b-1d4f-4787-a291-c67834d212e7"
+)
+
+// Identity is the user assigned managed identity the cloud controller manager and the CSI driver
+// authenticate with. It is attached to every node.
+type Identity struct {
+	identity.UserAssigned
+	RoleAssignments []*authorization.RoleAssignment
+}
+
+// roleScope is a resource group the identity is granted a role on, scopeId is empty for the one of the stack
+type roleScope struct {
+	name    string
+	scopeId string
+	roleId  string
+}
+
+type ProvisionIdentityParams struct {
+	ResourceGroup *resources.ResourceGroup
+}
+
+// ProvisionIdentity creates the identity along with a Contributor role assignment on the resource group, and
+// a Network Contributor one on the resource group of an existing subnet.
+func ProvisionIdentity(ctx *pulumi.Context, params ProvisionIdentityParams) (Identity, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	identityParams := identity.Params{ResourceGroup: params.ResourceGroup, Location: conf.AzRegion}
+	userAssigned, err := identity.NewUserAssigned(ctx, "cloud-provider-identity", "cloud-provider", identityParams)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	scopes := []roleScope{{"resource-group", "", contributorRoleId}}
+	if conf.ExistingSubnet != nil {
+		networkScope := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", conf.ExistingSubnet.SubscriptionId, conf.ExistingSubnet.ResourceGroupName)
+		scopes = append(scopes, roleScope{"network", networkScope, networkContributorRoleId})
+	}
+
+	roleAssignments := make([]*authorization.RoleAssignment, 0, len(scopes))
+	for _, scope := range scopes {
+		roleAssignment, err := identity.NewRoleAssignment(
+			ctx, fmt.Sprintf("cloud-provider-role-%s", scope.name), identityParams, scope.scopeId, scope.roleId, userAssigned.PrincipalId,
+		)
+		if err != nil {
+			return Identity{}, err
+		}
+		roleAssignments = append(roleAssignments, roleAssignment)
+	}
+
+	return Identity{userAssigned, roleAssignments}, nil
+}
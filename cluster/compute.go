@@ -2,27 +2,44 @@ package cluster
 
 import (
 	"encoding/base64"
-	"fmt"
 	"talos-azure/helpers"
 
 	compute "github.com/pulumi/pulumi-azure-native-sdk/compute/v2"
 	"github.com/pulumi/pulumi-azure-native-sdk/resources/v2"
+	"github.com/pulumi/pulumi-random/sdk/v4/go/random"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
 type ComputeResources struct {
 	AvailabilitySet *compute.AvailabilitySet
 	Nodes           []*compute.VirtualMachine
+	AdminPassword   *random.RandomPassword
+	ScaleSets       []*compute.VirtualMachineScaleSet
+	// PoolNodes and PoolScaleSets hold the same resources as Nodes and ScaleSets, keyed by pool name.
+	// Scale set pools have one scale set per availability zone, or a single one without zones.
+	PoolNodes     map[string][]*compute.VirtualMachine
+	PoolScaleSets map[string][]*compute.VirtualMachineScaleSet
 }
 
 type ProvisionComputeParams struct {
 	ResourceGroup  *resources.ResourceGroup
 	MachineConfigs MachineConfigs
-	WorkerNicIds   []pulumi.IDOutput
-	ControlNicIds  []pulumi.IDOutput
-	StorageAccUri  pulumi.StringPtrInput
-	SubnetID       pulumi.StringPtrOutput
-	NsgId          pulumi.IDOutput
+	// NicIds holds the NIC ids of every node pool, keyed by pool name and ordered by node index
+	NicIds        map[string][]pulumi.IDOutput
+	StorageAccUri pulumi.StringPtrInput
+	// WorkerSubnetIds are the worker subnets scale sets are placed into, one per availability zone or a single one
+	WorkerSubnetIds []pulumi.StringPtrOutput
+	// OutboundPoolIdsV6 holds the load balancer backend pool providing IPv6 egress to scale set instances, if any
+	OutboundPoolIdsV6 []pulumi.StringPtrOutput
+	NsgId             pulumi.IDOutput
+	// IdentityId is the managed identity attached to every node, nil without the cloud provider
+	IdentityId pulumi.StringInput
+	// PoolIdentityIds holds the user assigned identities of node pools, keyed by pool name
+	PoolIdentityIds map[string]pulumi.StringInput
+	// ImageId is the image VMs boot from, nil for the Sidero Labs community gallery image
+	ImageId pulumi.StringInput
+	// TalosVersion is the resolved cluster:talos-version, it selects the community gallery image
+	TalosVersion string
 }
 
 func ProvisionCompute(ctx *pulumi.Context, params ProvisionComputeParams) (ComputeResources, error) {
@@ -31,101 +48,141 @@ func ProvisionCompute(ctx *pulumi.Context, params ProvisionComputeParams) (Compu
 		return ComputeResources{}, err
 	}
 
-	availabilitySet, err := compute.NewAvailabilitySet(ctx, "availabilitySet", &compute.AvailabilitySetArgs{
-		ResourceGroupName: params.ResourceGroup.Name,
-		Location:          pulumi.String(conf.AzRegion),
-		Sku: compute.SkuArgs{
-			Name: pulumi.StringPtr("Aligned"),
-		},
-		PlatformFaultDomainCount: pulumi.Int(2),
+	// Nodes are either spread across availability zones or placed into a single availability set
+	var availabilitySet *compute.AvailabilitySet
+	var availabilitySetID pulumi.StringPtrInput
+	if len(conf.Zones) == 0 {
+		availabilitySet, err = compute.NewAvailabilitySet(ctx, "availabilitySet", &compute.AvailabilitySetArgs{
+			ResourceGroupName: params.ResourceGroup.Name,
+			Location:          pulumi.String(conf.AzRegion),
+			Sku: compute.SkuArgs{
+				Name: pulumi.StringPtr("Aligned"),
+			},
+			PlatformFaultDomainCount: pulumi.Int(2),
+		})
+		if err != nil {
+			return ComputeResources{}, err
+		}
+		availabilitySetID = availabilitySet.ID()
+	}
+
+	// Talos doesn't use the admin account, but Azure requires one. The password is generated
+	// once per stack and kept as a secret in the state.
+	adminPassword, err := random.NewRandomPassword(ctx, "vm-admin-password", &random.RandomPasswordArgs{
+		Length:          pulumi.Int(32),
+		MinLower:        pulumi.Int(1),
+		MinUpper:        pulumi.Int(1),
+		MinNumeric:      pulumi.Int(1),
+		MinSpecial:      pulumi.Int(1),
+		OverrideSpecial: pulumi.String("!#%&*()-_=+[]{}<>:?"),
 	})
 	if err != nil {
 		return ComputeResources{}, err
 	}
 
-	imageId := pulumi.Sprintf(
-		"/CommunityGalleries/siderolabs-c4d707c0-343e-42de-b597-276e4f7a5b0b/Images/%s/Versions/%s",
-		conf.Architecture,
-		conf.TalosVersion,
-	)
+	imageReference := &compute.ImageReferenceArgs{
+		CommunityGalleryImageId: pulumi.Sprintf(
+			"/CommunityGalleries/siderolabs-c4d707c0-343e-42de-b597-276e4f7a5b0b/Images/%s/Versions/%s",
+			conf.Architecture,
+			params.TalosVersion,
+		),
+	}
+	if params.ImageId != nil {
+		imageReference = &compute.ImageReferenceArgs{Id: params.ImageId}
+	}
 
 	nodes := make([]*compute.VirtualMachine, 0)
-	for i := 0; i < conf.ControlCount; i++ {
-		name := fmt.Sprintf("control-%d", i)
-		node, err := createNode(ctx, params, createNodeParams{
-			name:              name,
-			imageId:           imageId,
-			availabilitySetID: availabilitySet.ID(),
-			isControlplane:    true,
-			nicID:             params.ControlNicIds[i],
-			subnetID:          params.SubnetID,
-			nsgId:             params.NsgId,
-			vmSize:            conf.Vm,
-		})
-		if err != nil {
-			return ComputeResources{}, err
+	scaleSets := make([]*compute.VirtualMachineScaleSet, 0)
+	poolNodes := make(map[string][]*compute.VirtualMachine, len(conf.NodePools))
+	poolScaleSets := make(map[string][]*compute.VirtualMachineScaleSet)
+	for _, pool := range conf.NodePools {
+		if pool.ScaleSet {
+			poolSets, err := createScaleSets(ctx, params, createScaleSetParams{
+				pool:          pool,
+				image:         imageReference,
+				zones:         conf.Zones,
+				dualStack:     conf.AddressSpace.DualStack,
+				machineCfg:    params.MachineConfigs.Pools[pool.Name].MachineConfiguration(),
+				adminPassword: adminPassword.Result,
+			})
+			if err != nil {
+				return ComputeResources{}, err
+			}
+			scaleSets = append(scaleSets, poolSets...)
+			poolScaleSets[pool.Name] = poolSets
+			continue
 		}
-		nodes = append(nodes, node)
-	}
-	for i := 0; i < conf.WorkerCount; i++ {
-		name := fmt.Sprintf("worker-%d", i)
-		node, err := createNode(ctx, params, createNodeParams{
-			name:              name,
-			imageId:           imageId,
-			availabilitySetID: availabilitySet.ID(),
-			isControlplane:    false,
-			nicID:             params.WorkerNicIds[i],
-			subnetID:          params.SubnetID,
-			nsgId:             params.NsgId,
-			vmSize:            conf.Vm,
-		})
-		if err != nil {
-			return ComputeResources{}, err
+		for i := 0; i < pool.Count; i++ {
+			node, err := createNode(ctx, params, createNodeParams{
+				name:              pool.NodeName(i),
+				image:             imageReference,
+				availabilitySetID: availabilitySetID,
+				zone:              conf.NodeZone(i),
+				machineCfg:        params.MachineConfigs.ForNode(pool, i),
+				nicID:             params.NicIds[pool.Name][i],
+				nsgId:             params.NsgId,
+				vmSize:            pool.VmSize,
+				osDiskSizeGB:      pool.OsDiskSizeGB,
+				adminPassword:     adminPassword.Result,
+				spot:              getSpotSettings(pool),
+				identity:          vmIdentity(params, pool),
+			})
+			if err != nil {
+				return ComputeResources{}, err
+			}
+			nodes = append(nodes, node)
+			poolNodes[pool.Name] = append(poolNodes[pool.Name], node)
 		}
-		nodes = append(nodes, node)
 	}
 
-	return ComputeResources{availabilitySet, nodes}, nil
+	return ComputeResources{availabilitySet, nodes, adminPassword, scaleSets, poolNodes, poolScaleSets}, nil
 }
 
 type createNodeParams struct {
 	name              string
-	imageId           pulumi.StringOutput
+	image             compute.ImageReferencePtrInput
 	availabilitySetID pulumi.StringPtrInput
-	isControlplane    bool
+	zone              string
+	machineCfg        pulumi.StringOutput
 	nicID             pulumi.IDOutput
-	subnetID          pulumi.StringPtrInput
 	nsgId             pulumi.IDOutput
 	vmSize            string
+	osDiskSizeGB      int
+	adminPassword     pulumi.StringOutput
+	spot              spotSettings
+	identity          compute.VirtualMachineIdentityPtrInput
 }
 
 func createNode(ctx *pulumi.Context, params ProvisionComputeParams, nodeParams createNodeParams) (*compute.VirtualMachine, error) {
-	var machineCfg pulumi.StringOutput
-	if nodeParams.isControlplane {
-		machineCfg = params.MachineConfigs.Controlplane.MachineConfiguration()
-	} else {
-		machineCfg = params.MachineConfigs.Worker.MachineConfiguration()
+	var availabilitySet compute.SubResourcePtrInput
+	if nodeParams.availabilitySetID != nil {
+		availabilitySet = compute.SubResourceArgs{Id: nodeParams.availabilitySetID}
+	}
+	var zones pulumi.StringArrayInput
+	if nodeParams.zone != "" {
+		zones = pulumi.StringArray{pulumi.String(nodeParams.zone)}
 	}
 
+	// The image and custom data are only read on first boot and changing them would replace the VM and its etcd
+	// member. Machine configs are applied in place instead, see ApplyMachineConfigs, and Talos and Kubernetes
+	// versions are upgraded in place, see UpgradeTalos and UpgradeKubernetes.
 	return compute.NewVirtualMachine(ctx, nodeParams.name, &compute.VirtualMachineArgs{
 		ResourceGroupName: params.ResourceGroup.Name,
 		HardwareProfile: &compute.HardwareProfileArgs{
 			VmSize: pulumi.String(nodeParams.vmSize),
 		},
 		StorageProfile: compute.StorageProfileArgs{
-			ImageReference: &compute.ImageReferenceArgs{
-				CommunityGalleryImageId: nodeParams.imageId,
-			},
+			ImageReference: nodeParams.image,
 			OsDisk: compute.OSDiskArgs{
-				DiskSizeGB:   pulumi.Int(10),
+				DiskSizeGB:   pulumi.Int(nodeParams.osDiskSizeGB),
 				CreateOption: pulumi.String(compute.DiskCreateOptionTypesFromImage)},
 		},
 		OsProfile: compute.OSProfileArgs{
-			CustomData:   machineCfg.ApplyT(func(v string) string { return base64.StdEncoding.EncodeToString([]byte(v)) }).(pulumi.StringOutput),
+			CustomData:   encodeCustomData(nodeParams.machineCfg),
 			ComputerName: pulumi.String(nodeParams.name),
 			// The following two are not used, but are required by the api
 			AdminUsername: pulumi.String("talos"),
-			AdminPassword: pulumi.String("talosASD123&€#"),
+			AdminPassword: nodeParams.adminPassword,
 		},
 		DiagnosticsProfile: &compute.DiagnosticsProfileArgs{
 			BootDiagnostics: &compute.BootDiagnosticsArgs{
@@ -138,8 +195,68 @@ func createNode(ctx *pulumi.Context, params ProvisionComputeParams, nodeParams c
 				Id: nodeParams.nicID,
 			}},
 		},
-		AvailabilitySet: compute.SubResourceArgs{
-			Id: nodeParams.availabilitySetID,
+		AvailabilitySet: availabilitySet,
+		Zones:           zones,
+		Priority:        nodeParams.spot.priority,
+		EvictionPolicy:  nodeParams.spot.evictionPolicy,
+		BillingProfile:  nodeParams.spot.billingProfile,
+	}, pulumi.IgnoreChanges([]string{"storageProfile.imageReference", "osProfile.customData"}))
+}
+
+// spotSettings are left empty for regular, non spot pools
+type spotSettings struct {
+	priority       pulumi.StringPtrInput
+	evictionPolicy pulumi.StringPtrInput
+	billingProfile compute.BillingProfilePtrInput
+}
+
+func getSpotSettings(pool helpers.NodePool) spotSettings {
+	if !pool.Spot {
+		return spotSettings{}
+	}
+	return spotSettings{
+		priority:       pulumi.String(compute.VirtualMachinePriorityTypesSpot),
+		evictionPolicy: pulumi.String(pool.EvictionPolicy),
+		billingProfile: compute.BillingProfileArgs{
+			MaxPrice: pulumi.Float64(*pool.MaxPrice),
 		},
-	})
+	}
+}
+
+// nodeIdentities combines the identity attached to every node with the identity of the pool. The returned type
+// is empty when the nodes of the pool have no identity at all.
+func nodeIdentities(params ProvisionComputeParams, pool helpers.NodePool) (compute.ResourceIdentityType, pulumi.StringArray) {
+	var ids pulumi.StringArray
+	if params.IdentityId != nil {
+		ids = append(ids, params.IdentityId)
+	}
+	if id, ok := params.PoolIdentityIds[pool.Name]; ok {
+		ids = append(ids, id)
+	}
+	systemAssigned := pool.Identity != nil && pool.Identity.Type == helpers.IdentityTypeSystemAssigned
+
+	switch {
+	case systemAssigned && len(ids) > 0:
+		return compute.ResourceIdentityType_SystemAssigned_UserAssigned, ids
+	case systemAssigned:
+		return compute.ResourceIdentityTypeSystemAssigned, nil
+	case len(ids) > 0:
+		return compute.ResourceIdentityTypeUserAssigned, ids
+	}
+	return "", nil
+}
+
+func vmIdentity(params ProvisionComputeParams, pool helpers.NodePool) compute.VirtualMachineIdentityPtrInput {
+	identityType, ids := nodeIdentities(params, pool)
+	if identityType == "" {
+		return nil
+	}
+	return compute.VirtualMachineIdentityArgs{
+		Type:                   identityType,
+		UserAssignedIdentities: ids,
+	}
+}
+
+func encodeCustomData(machineCfg pulumi.StringOutput) pulumi.StringOutput {
+	return machineCfg.ApplyT(func(v string) string { return base64.StdEncoding.EncodeToString([]byte(v)) }).(pulumi.StringOutput)
 }
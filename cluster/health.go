@@ -0,0 +1,152 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/client"
+	talosCluster "github.com/pulumiverse/pulumi-talos/sdk/go/talos/cluster"
+)
+
+type HealthCheckNode struct {
+	Name         string
+	PrivateIp    pulumi.StringPtrOutput
+	Controlplane bool
+	// Evicted resolves to true for spot VMs that Azure deallocated, they are skipped. Nil for other nodes.
+	Evicted pulumi.BoolInput
+}
+
+// nodeInputs returns the private IPs of the nodes followed by their eviction state, as read by resolveNodes
+func nodeInputs(nodes []HealthCheckNode) []interface{} {
+	inputs := make([]interface{}, 0, 2*len(nodes))
+	for _, node := range nodes {
+		inputs = append(inputs, node.PrivateIp)
+	}
+	for _, node := range nodes {
+		evicted := node.Evicted
+		if evicted == nil {
+			evicted = pulumi.Bool(false)
+		}
+		inputs = append(inputs, evicted)
+	}
+	return inputs
+}
+
+// resolveNodes resolves the nodes from the resolved nodeInputs
+func resolveNodes(nodes []HealthCheckNode, args []interface{}) []talosNode {
+	resolved := make([]talosNode, len(nodes))
+	for i, node := range nodes {
+		resolved[i] = talosNode{
+			name:         node.Name,
+			ip:           *args[i].(*string),
+			controlplane: node.Controlplane,
+			evicted:      args[len(nodes)+i].(bool),
+		}
+	}
+	return resolved
+}
+
+type WaitForHealthyParams struct {
+	ClientCfg *client.GetConfigurationResultOutput
+	// Endpoints are the publicly reachable control plane addresses the talos client connects through
+	Endpoints     []pulumi.StringPtrOutput
+	Nodes         []HealthCheckNode
+	ScaleSetPools []ScaleSetPool
+	// Timeout is a duration string such as "10m"
+	Timeout string
+	// ReadyAfter delays the check until the given output resolves, e.g. the bootstrap resource id
+	ReadyAfter pulumi.StringInput
+}
+
+// WaitForHealthy waits until etcd, kubelet and the API server are healthy on every node, including the scale set
+// instances that joined the cluster. The returned output reports the Talos version and service health of every
+// node and has to be exported for a failed check to fail the update. Evicted spot nodes are reported and skipped.
+func WaitForHealthy(ctx *pulumi.Context, params WaitForHealthyParams) pulumi.StringMapOutput {
+	clientCfg := params.ClientCfg.ClientConfiguration()
+	inputs := []interface{}{
+		params.ReadyAfter,
+		clientCfg.CaCertificate(),
+		clientCfg.ClientCertificate(),
+		clientCfg.ClientKey(),
+		params.ClientCfg.TalosConfig(),
+	}
+	for _, endpoint := range params.Endpoints {
+		inputs = append(inputs, endpoint)
+	}
+	inputs = append(inputs, nodeInputs(params.Nodes)...)
+
+	return pulumi.All(inputs...).ApplyT(func(args []interface{}) (map[string]string, error) {
+		report := make(map[string]string, len(params.Nodes))
+		if ctx.DryRun() {
+			for _, node := range params.Nodes {
+				report[node.Name] = "skipped during preview"
+			}
+			return report, nil
+		}
+
+		endpoints := make([]string, len(params.Endpoints))
+		for i := range params.Endpoints {
+			endpoints[i] = *args[5+i].(*string)
+		}
+		nodes := resolveNodes(params.Nodes, args[5+len(params.Endpoints):])
+
+		talosClient, err := newTalosClient(ctx.Context(), args[4].(string))
+		if err != nil {
+			return nil, err
+		}
+		defer talosClient.Close()
+		scaleSetNodes, err := scaleSetNodes(ctx.Context(), talosClient, controlIps(nodes)[0], params.ScaleSetPools, nodes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover scale set nodes: %w", err)
+		}
+		nodes, evicted := splitEvicted(append(nodes, scaleSetNodes...), answersWithin(ctx.Context(), talosClient))
+		for _, node := range evicted {
+			report[node.name] = fmt.Sprintf("%s, %s: evicted spot instance, skipped", node.role(), node.ip)
+		}
+
+		var controlNodes, workerNodes []string
+		for _, node := range nodes {
+			if node.controlplane {
+				controlNodes = append(controlNodes, node.ip)
+			} else {
+				workerNodes = append(workerNodes, node.ip)
+			}
+		}
+		_, healthErr := talosCluster.GetHealth(ctx, &talosCluster.GetHealthArgs{
+			ClientConfiguration: talosCluster.GetHealthClientConfiguration{
+				CaCertificate:     args[1].(string),
+				ClientCertificate: args[2].(string),
+				ClientKey:         args[3].(string),
+			},
+			Endpoints:         endpoints,
+			ControlPlaneNodes: controlNodes,
+			WorkerNodes:       workerNodes,
+			Timeouts: &talosCluster.GetHealthTimeouts{
+				Read: &params.Timeout,
+			},
+		})
+
+		lines := make([]string, len(nodes))
+		for i, node := range nodes {
+			report[node.name] = fmt.Sprintf("%s, %s: %s", node.role(), node.ip, nodeStatus(ctx.Context(), talosClient, node))
+			lines[i] = fmt.Sprintf("  %s (%s)", node.name, report[node.name])
+		}
+		if healthErr != nil {
+			return nil, fmt.Errorf("cluster did not become healthy within %s, node status:\n%s\n%w",
+				params.Timeout, strings.Join(lines, "\n"), healthErr)
+		}
+		return report, nil
+	}).(pulumi.StringMapOutput)
+}
+
+// controlIps returns the addresses of the control plane nodes, control plane pools can't be empty
+func controlIps(nodes []talosNode) []string {
+	var ips []string
+	for _, node := range nodes {
+		if node.controlplane {
+			ips = append(ips, node.ip)
+		}
+	}
+	return ips
+}
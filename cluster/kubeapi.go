@@ -0,0 +1,224 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// errNotFound is returned for Kubernetes objects that don't exist
+var errNotFound = errors.New("not found")
+
+// kubeClient is a minimal Kubernetes API client authenticating with the client certificate of the admin kubeconfig
+type kubeClient struct {
+	server     string
+	httpClient *http.Client
+}
+
+type kubeconfig struct {
+	Clusters []struct {
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		User struct {
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// newKubeClient connects to the first cluster of the kubeconfig as its first user, as in the kubeconfig Talos generates
+func newKubeClient(rawKubeconfig string) (*kubeClient, error) {
+	var cfg kubeconfig
+	err := yaml.Unmarshal([]byte(rawKubeconfig), &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+	if len(cfg.Clusters) == 0 || len(cfg.Users) == 0 {
+		return nil, fmt.Errorf("kubeconfig contains no cluster or user")
+	}
+
+	decode := func(name string, data string) ([]byte, error) {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig %s is invalid: %w", name, err)
+		}
+		return decoded, nil
+	}
+	ca, err := decode("certificate-authority-data", cfg.Clusters[0].Cluster.CertificateAuthorityData)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := decode("client-certificate-data", cfg.Users[0].User.ClientCertificateData)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decode("client-key-data", cfg.Users[0].User.ClientKeyData)
+	if err != nil {
+		return nil, err
+	}
+	keyPair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("kubeconfig client certificate is invalid: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("kubeconfig certificate-authority-data contains no certificate")
+	}
+
+	return &kubeClient{
+		server: strings.TrimSuffix(cfg.Clusters[0].Cluster.Server, "/"),
+		httpClient: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      pool,
+				Certificates: []tls.Certificate{keyPair},
+				MinVersion:   tls.VersionTLS12,
+			},
+		}},
+	}, nil
+}
+
+// get decodes the object at path into out, it returns errNotFound for missing objects
+func (k *kubeClient) get(ctx context.Context, path string, out interface{}) error {
+	return k.do(ctx, http.MethodGet, path, "", nil, out)
+}
+
+// patch applies a strategic merge patch to the object at path
+func (k *kubeClient) patch(ctx context.Context, path string, patch interface{}) error {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("failed to encode patch of %s: %w", path, err)
+	}
+	return k.do(ctx, http.MethodPatch, path, "application/strategic-merge-patch+json", body, nil)
+}
+
+func (k *kubeClient) do(ctx context.Context, method string, path string, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, k.server+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", method, path, errNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s failed: %s: %s", method, path, resp.Status, bytes.TrimSpace(message))
+	}
+	if out == nil {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// podStatus is the part of a pod the upgrade checks
+type podStatus struct {
+	Spec struct {
+		Containers []struct {
+			Image string `json:"image"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// podReady checks that the pod runs image and is ready. Static pods are checked through their mirror pods.
+func (k *kubeClient) podReady(ctx context.Context, namespace string, name string, image string) error {
+	var pod podStatus
+	err := k.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name), &pod)
+	if err != nil {
+		return err
+	}
+	if len(pod.Spec.Containers) == 0 || pod.Spec.Containers[0].Image != image {
+		return fmt.Errorf("pod %s doesn't run %s yet", name, image)
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == "Ready" && condition.Status == "True" {
+			return nil
+		}
+	}
+	return fmt.Errorf("pod %s isn't ready", name)
+}
+
+// nodeReady checks that the kubelet of the node runs version and reports the node ready
+func (k *kubeClient) nodeReady(ctx context.Context, name string, version string) error {
+	var node struct {
+		Status struct {
+			NodeInfo struct {
+				KubeletVersion string `json:"kubeletVersion"`
+			} `json:"nodeInfo"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	}
+	err := k.get(ctx, "/api/v1/nodes/"+name, &node)
+	if err != nil {
+		return err
+	}
+	if node.Status.NodeInfo.KubeletVersion != version {
+		return fmt.Errorf("node %s runs kubelet %s", name, node.Status.NodeInfo.KubeletVersion)
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == "Ready" && condition.Status == "True" {
+			return nil
+		}
+	}
+	return fmt.Errorf("node %s isn't ready", name)
+}
+
+// daemonSetRolledOut checks that every pod of the DaemonSet was updated and is available
+func (k *kubeClient) daemonSetRolledOut(ctx context.Context, namespace string, name string) error {
+	var daemonSet struct {
+		Metadata struct {
+			Generation int64 `json:"generation"`
+		} `json:"metadata"`
+		Status struct {
+			ObservedGeneration     int64 `json:"observedGeneration"`
+			DesiredNumberScheduled int   `json:"desiredNumberScheduled"`
+			UpdatedNumberScheduled int   `json:"updatedNumberScheduled"`
+			NumberAvailable        int   `json:"numberAvailable"`
+		} `json:"status"`
+	}
+	err := k.get(ctx, fmt.Sprintf("/apis/apps/v1/namespaces/%s/daemonsets/%s", namespace, name), &daemonSet)
+	if err != nil {
+		return err
+	}
+	status := daemonSet.Status
+	if status.ObservedGeneration < daemonSet.Metadata.Generation ||
+		status.UpdatedNumberScheduled < status.DesiredNumberScheduled ||
+		status.NumberAvailable < status.DesiredNumberScheduled {
+		return fmt.Errorf("daemonset %s rolled out to %d of %d nodes", name, status.UpdatedNumberScheduled, status.DesiredNumberScheduled)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package cluster
+
+import (
+	"fmt"
+	"talos-azure/helpers"
+
+	compute "github.com/pulumi/pulumi-azure-native-sdk/compute/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+type createScaleSetParams struct {
+	pool          helpers.NodePool
+	image         compute.ImageReferencePtrInput
+	zones         []string
+	dualStack     bool
+	machineCfg    pulumi.StringOutput
+	adminPassword pulumi.StringOutput
+}
+
+// createScaleSets backs a worker pool with Flexible orchestration scale sets. With zones the pool gets one scale
+// set per zone, placed into the subnet of that zone so instances egress through the NAT gateway of their zone.
+// The pool count is spread across the zones like the nodes of VM pools.
+func createScaleSets(ctx *pulumi.Context, params ProvisionComputeParams, scaleSetParams createScaleSetParams) ([]*compute.VirtualMachineScaleSet, error) {
+	pool := scaleSetParams.pool
+	if len(scaleSetParams.zones) == 0 {
+		scaleSet, err := createScaleSet(ctx, params, scaleSetParams, fmt.Sprintf("%s-vmss", pool.Name), "", params.WorkerSubnetIds[0], pool.Count)
+		if err != nil {
+			return nil, err
+		}
+		return []*compute.VirtualMachineScaleSet{scaleSet}, nil
+	}
+
+	zoneCount := len(scaleSetParams.zones)
+	scaleSets := make([]*compute.VirtualMachineScaleSet, zoneCount)
+	for i, zone := range scaleSetParams.zones {
+		capacity := pool.Count / zoneCount
+		if i < pool.Count%zoneCount {
+			capacity++
+		}
+		subnetId := params.WorkerSubnetIds[i%len(params.WorkerSubnetIds)]
+		scaleSet, err := createScaleSet(ctx, params, scaleSetParams, fmt.Sprintf("%s-vmss-%s", pool.Name, zone), zone, subnetId, capacity)
+		if err != nil {
+			return nil, err
+		}
+		scaleSets[i] = scaleSet
+	}
+	return scaleSets, nil
+}
+
+// createScaleSet creates a single scale set of the pool. The capacity is only used initially, afterwards the scale
+// set can be scaled in Azure directly.
+func createScaleSet(
+	ctx *pulumi.Context,
+	params ProvisionComputeParams,
+	scaleSetParams createScaleSetParams,
+	name string,
+	zone string,
+	subnetId pulumi.StringPtrOutput,
+	capacity int,
+) (*compute.VirtualMachineScaleSet, error) {
+	pool := scaleSetParams.pool
+	spot := getSpotSettings(pool)
+	var zones pulumi.StringArrayInput
+	if zone != "" {
+		zones = pulumi.StringArray{pulumi.String(zone)}
+	}
+	ipConfigs := compute.VirtualMachineScaleSetIPConfigurationArray{
+		compute.VirtualMachineScaleSetIPConfigurationArgs{
+			Name:    pulumi.String(fmt.Sprintf("%s-ip-conf", pool.Name)),
+			Primary: pulumi.Bool(true),
+			Subnet: compute.ApiEntityReferenceArgs{
+				Id: subnetId,
+			},
+		},
+	}
+	// The IPv6 address is a secondary IP configuration, the primary one has to be IPv4. It egresses through the
+	// outbound rule of the load balancer, the NAT gateway only handles IPv4.
+	if scaleSetParams.dualStack {
+		outboundPools := compute.SubResourceArray{}
+		for _, id := range params.OutboundPoolIdsV6 {
+			outboundPools = append(outboundPools, compute.SubResourceArgs{Id: id})
+		}
+		ipConfigs = append(ipConfigs, compute.VirtualMachineScaleSetIPConfigurationArgs{
+			Name:                    pulumi.String(fmt.Sprintf("%s-ip-conf-v6", pool.Name)),
+			Primary:                 pulumi.Bool(false),
+			PrivateIPAddressVersion: pulumi.String(compute.IPVersionIPv6),
+			Subnet: compute.ApiEntityReferenceArgs{
+				Id: subnetId,
+			},
+			LoadBalancerBackendAddressPools: outboundPools,
+		})
+	}
+
+	return compute.NewVirtualMachineScaleSet(ctx, name, &compute.VirtualMachineScaleSetArgs{
+		ResourceGroupName:        params.ResourceGroup.Name,
+		OrchestrationMode:        pulumi.String(compute.OrchestrationModeFlexible),
+		PlatformFaultDomainCount: pulumi.Int(1),
+		SinglePlacementGroup:     pulumi.Bool(false),
+		Zones:                    zones,
+		Identity:                 scaleSetIdentity(params, pool),
+		Sku: compute.SkuArgs{
+			Name:     pulumi.String(pool.VmSize),
+			Capacity: pulumi.Float64(float64(capacity)),
+		},
+		VirtualMachineProfile: compute.VirtualMachineScaleSetVMProfileArgs{
+			Priority:       spot.priority,
+			EvictionPolicy: spot.evictionPolicy,
+			BillingProfile: spot.billingProfile,
+			StorageProfile: compute.VirtualMachineScaleSetStorageProfileArgs{
+				// Unlike the one of VMs the image isn't ignored, new instances start with the current Talos version
+				// while existing ones are upgraded in place
+				ImageReference: scaleSetParams.image,
+				OsDisk: compute.VirtualMachineScaleSetOSDiskArgs{
+					DiskSizeGB:   pulumi.Int(pool.OsDiskSizeGB),
+					CreateOption: pulumi.String(compute.DiskCreateOptionTypesFromImage),
+				},
+			},
+			OsProfile: compute.VirtualMachineScaleSetOSProfileArgs{
+				CustomData:         encodeCustomData(scaleSetParams.machineCfg),
+				ComputerNamePrefix: pulumi.String(pool.Name),
+				// The following two are not used, but are required by the api
+				AdminUsername: pulumi.String("talos"),
+				AdminPassword: scaleSetParams.adminPassword,
+			},
+			DiagnosticsProfile: &compute.DiagnosticsProfileArgs{
+				BootDiagnostics: &compute.BootDiagnosticsArgs{
+					Enabled:    pulumi.Bool(true),
+					StorageUri: params.StorageAccUri,
+				},
+			},
+			NetworkProfile: compute.VirtualMachineScaleSetNetworkProfileArgs{
+				// Required for Flexible orchestration
+				NetworkApiVersion: pulumi.String(compute.NetworkApiVersion_2020_11_01),
+				NetworkInterfaceConfigurations: compute.VirtualMachineScaleSetNetworkConfigurationArray{
+					compute.VirtualMachineScaleSetNetworkConfigurationArgs{
+						Name:    pulumi.String(fmt.Sprintf("%s-nic", pool.Name)),
+						Primary: pulumi.Bool(true),
+						NetworkSecurityGroup: compute.SubResourceArgs{
+							Id: params.NsgId,
+						},
+						IpConfigurations: ipConfigs,
+					},
+				},
+			},
+		},
+	}, pulumi.IgnoreChanges([]string{"sku.capacity"}))
+}
+
+func scaleSetIdentity(params ProvisionComputeParams, pool helpers.NodePool) compute.VirtualMachineScaleSetIdentityPtrInput {
+	identityType, ids := nodeIdentities(params, pool)
+	if identityType == "" {
+		return nil
+	}
+	return compute.VirtualMachineScaleSetIdentityArgs{
+		Type:                   identityType,
+		UserAssignedIdentities: ids,
+	}
+}
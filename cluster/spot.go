@@ -0,0 +1,70 @@
+package cluster
+
+import (
+	"context"
+	"time"
+
+	compute "github.com/pulumi/pulumi-azure-native-sdk/compute/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
+)
+
+// spotProbeTimeout is how long a spot scale set instance gets to answer before it is considered evicted
+const spotProbeTimeout = 10 * time.Second
+
+// ScaleSetPool is a scale set pool whose instances are discovered through the cluster members
+type ScaleSetPool struct {
+	Name string
+	// Spot instances that don't answer are considered evicted and skipped
+	Spot bool
+}
+
+// VmEvicted reports whether Azure deallocated the VM, which it does when evicting spot VMs with the Deallocate
+// eviction policy. The lookup runs on every update, so nodes are checked again once they were started.
+func VmEvicted(ctx *pulumi.Context, resourceGroupName pulumi.StringInput, vm *compute.VirtualMachine) pulumi.BoolOutput {
+	return compute.LookupVirtualMachineOutput(ctx, compute.LookupVirtualMachineOutputArgs{
+		ResourceGroupName: resourceGroupName,
+		VmName:            vm.Name,
+		Expand:            pulumi.String("instanceView"),
+	}).ApplyT(func(result compute.LookupVirtualMachineResult) bool {
+		return deallocated(result.InstanceView.Statuses)
+	}).(pulumi.BoolOutput)
+}
+
+// deallocated checks the power state of an instance view, a VM that is being deallocated counts as deallocated
+func deallocated(statuses []compute.InstanceViewStatusResponse) bool {
+	for _, status := range statuses {
+		if status.Code == nil {
+			continue
+		}
+		switch *status.Code {
+		case "PowerState/deallocated", "PowerState/deallocating":
+			return true
+		}
+	}
+	return false
+}
+
+// splitEvicted separates evicted spot nodes from the ones health checks and upgrades run against. VMs are known
+// to be evicted from their power state, spot scale set instances are evicted when they don't answer.
+func splitEvicted(nodes []talosNode, answers func(talosNode) bool) ([]talosNode, []talosNode) {
+	var online, evicted []talosNode
+	for _, node := range nodes {
+		if node.evicted || (node.spot && !answers(node)) {
+			evicted = append(evicted, node)
+		} else {
+			online = append(online, node)
+		}
+	}
+	return online, evicted
+}
+
+// answersWithin reports whether the Talos API of the node answers within spotProbeTimeout
+func answersWithin(ctx context.Context, c *talosclient.Client) func(talosNode) bool {
+	return func(node talosNode) bool {
+		probeCtx, cancel := context.WithTimeout(ctx, spotProbeTimeout)
+		defer cancel()
+		_, err := talosVersion(probeCtx, c, node.ip)
+		return err == nil
+	}
+}
@@ -0,0 +1,81 @@
+package cluster
+
+import (
+	"slices"
+	"testing"
+
+	compute "github.com/pulumi/pulumi-azure-native-sdk/compute/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+func TestDeallocated(t *testing.T) {
+	status := func(code string) compute.InstanceViewStatusResponse {
+		return compute.InstanceViewStatusResponse{Code: &code}
+	}
+	tests := []struct {
+		name     string
+		statuses []compute.InstanceViewStatusResponse
+		want     bool
+	}{
+		{"running", []compute.InstanceViewStatusResponse{status("ProvisioningState/succeeded"), status("PowerState/running")}, false},
+		{"evicted", []compute.InstanceViewStatusResponse{status("ProvisioningState/succeeded"), status("PowerState/deallocated")}, true},
+		{"being evicted", []compute.InstanceViewStatusResponse{status("PowerState/deallocating")}, true},
+		{"stopped", []compute.InstanceViewStatusResponse{status("PowerState/stopped")}, false},
+		{"no instance view", nil, false},
+		{"no code", []compute.InstanceViewStatusResponse{{}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deallocated(tt.statuses); got != tt.want {
+				t.Errorf("deallocated() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitEvicted(t *testing.T) {
+	control := talosNode{name: "control-0", ip: "10.0.0.4", controlplane: true}
+	worker := talosNode{name: "worker-0", ip: "10.0.1.4"}
+	evictedVm := talosNode{name: "spot-0", ip: "10.0.1.5", evicted: true}
+	runningInstance := talosNode{name: "spotvmss000001", ip: "10.0.1.6", spot: true}
+	evictedInstance := talosNode{name: "spotvmss000002", ip: "10.0.1.7", spot: true}
+
+	probed := make([]string, 0)
+	answers := func(node talosNode) bool {
+		probed = append(probed, node.name)
+		return node.name != evictedInstance.name
+	}
+	online, evicted := splitEvicted([]talosNode{control, worker, evictedVm, runningInstance, evictedInstance}, answers)
+
+	if want := []talosNode{control, worker, runningInstance}; !slices.Equal(online, want) {
+		t.Errorf("online = %v, want %v", online, want)
+	}
+	if want := []talosNode{evictedVm, evictedInstance}; !slices.Equal(evicted, want) {
+		t.Errorf("evicted = %v, want %v", evicted, want)
+	}
+	// Only spot scale set instances are probed, evicted VMs are known from their power state
+	if want := []string{runningInstance.name, evictedInstance.name}; !slices.Equal(probed, want) {
+		t.Errorf("probed = %v, want %v", probed, want)
+	}
+}
+
+func TestResolveNodes(t *testing.T) {
+	nodes := []HealthCheckNode{
+		{Name: "control-0", Controlplane: true},
+		{Name: "spot-0", Evicted: pulumi.Bool(true)},
+	}
+	inputs := nodeInputs(nodes)
+	if len(inputs) != 4 || inputs[3] != pulumi.Bool(true) || inputs[2] != pulumi.Bool(false) {
+		t.Fatalf("nodeInputs() = %v, want the IPs followed by the eviction state", inputs)
+	}
+
+	controlIp, spotIp := "10.0.0.4", "10.0.1.4"
+	got := resolveNodes(nodes, []interface{}{&controlIp, &spotIp, false, true})
+	want := []talosNode{
+		{name: "control-0", ip: controlIp, controlplane: true},
+		{name: "spot-0", ip: spotIp, evicted: true},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("resolveNodes() = %v, want %v", got, want)
+	}
+}
@@ -1,10 +1,16 @@
 package cluster
 
 import (
+	"encoding/json"
 	"fmt"
+	"talos-azure/cni"
+	"talos-azure/helpers"
 
+	compute "github.com/pulumi/pulumi-azure-native-sdk/compute/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/network/v2"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/client"
+	talosCluster "github.com/pulumiverse/pulumi-talos/sdk/go/talos/cluster"
 	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/machine"
 )
 
@@ -18,11 +24,29 @@ func GetMachineSecrets(ctx *pulumi.Context, clusterName string, publicIp pulumi.
 
 type CommonProps struct {
 	ClusterName string
-	PublicIp    pulumi.StringPtrInput
-	Secrets     *machine.Secrets
+	// ApiIp is the load balancer frontend IP the cluster endpoint points at
+	ApiIp pulumi.StringPtrInput
+	// ApiIpV6 is the IPv6 load balancer frontend IP, only used for dual-stack clusters
+	ApiIpV6 pulumi.StringPtrInput
+	Secrets *machine.Secrets
+	// TalosEndpoints are the control plane addresses set as endpoints in the talos client config
+	TalosEndpoints []pulumi.StringPtrOutput
+	// CloudProviderPatch installs the Azure cloud provider, only used when it is enabled
+	CloudProviderPatch pulumi.StringInput
+	// InstallerImage replaces the default installer image, e.g. with one of an Image Factory schematic
+	InstallerImage string
+	// TalosVersion is the version whose config contract machine configs are generated for, without the v prefix
+	TalosVersion string
+	// KubernetesVersion is put into the machine configs, the Talos default when empty. It has to stay at the
+	// deployed version while UpgradeKubernetes rolls out a new one, applied configs would update all nodes at once.
+	KubernetesVersion string
 }
 
 func GetClusterClientCfg(ctx *pulumi.Context, props CommonProps) *client.GetConfigurationResultOutput {
+	endpoints := make(pulumi.StringArray, len(props.TalosEndpoints))
+	for i, endpoint := range props.TalosEndpoints {
+		endpoints[i] = endpoint.Elem()
+	}
 	res := client.GetConfigurationOutput(ctx, client.GetConfigurationOutputArgs{
 		ClusterName: pulumi.String(props.ClusterName),
 		ClientConfiguration: client.GetConfigurationClientConfigurationArgs{
@@ -31,37 +55,309 @@ func GetClusterClientCfg(ctx *pulumi.Context, props CommonProps) *client.GetConf
 			ClientKey:         props.Secrets.ClientConfiguration.ClientKey(),
 		},
 		Nodes: pulumi.StringArray{
-			props.PublicIp.ToStringPtrOutput().Elem().ToStringOutput(),
+			props.ApiIp.ToStringPtrOutput().Elem().ToStringOutput(),
 		},
+		Endpoints: endpoints,
 	})
 	return &res
 }
 
 type MachineConfigs struct {
-	Controlplane *machine.GetConfigurationResultOutput
-	Worker       *machine.GetConfigurationResultOutput
+	// Pools holds the generated machine configuration of every node pool, keyed by pool name
+	Pools map[string]*machine.GetConfigurationResultOutput
+	// Nodes holds the configuration of nodes that have their own patches, keyed by node name
+	Nodes map[string]*machine.GetConfigurationResultOutput
+}
+
+// ForNode returns the machine configuration of the i-th node of the given pool
+func (m MachineConfigs) ForNode(pool helpers.NodePool, i int) pulumi.StringOutput {
+	if cfg, ok := m.Nodes[pool.NodeName(i)]; ok {
+		return cfg.MachineConfiguration()
+	}
+	return m.Pools[pool.Name].MachineConfiguration()
+}
+
+func GetMachineConfiguration(ctx *pulumi.Context, props CommonProps) (MachineConfigs, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return MachineConfigs{}, err
+	}
+
+	// The endpoint domain keeps certificates and kubeconfigs valid when the load balancer IP changes
+	endpointHost := props.ApiIp.ToStringPtrOutput().Elem()
+	if conf.EndpointDomain != "" {
+		endpointHost = pulumi.String(conf.EndpointDomain).ToStringOutput()
+	}
+	endpoint := pulumi.Sprintf("https://%s:6443", endpointHost)
+	// Patches that depend on other resources precede the static ones
+	outputPatches := pulumi.StringArray{certSansPatch(conf, props)}
+	if conf.CloudProvider {
+		outputPatches = append(outputPatches, props.CloudProviderPatch)
+	}
+	cniPatch, err := cni.ConfigPatch(ctx)
+	if err != nil {
+		return MachineConfigs{}, err
+	}
+	if cniPatch != nil {
+		outputPatches = append(outputPatches, cniPatch)
+	}
+	// The contract of the provider is used without a version
+	var talosVersion pulumi.StringPtrInput
+	if props.TalosVersion != "" {
+		talosVersion = pulumi.String("v" + props.TalosVersion)
+	}
+	// The Talos default is used without cluster:kubernetesVersion
+	var kubernetesVersion pulumi.StringPtrInput
+	if props.KubernetesVersion != "" {
+		kubernetesVersion = pulumi.String(props.KubernetesVersion)
+	}
+	getConfig := func(role string, patches []string) *machine.GetConfigurationResultOutput {
+		cfg := machine.GetConfigurationOutput(ctx, machine.GetConfigurationOutputArgs{
+			ClusterName:       pulumi.String(props.ClusterName),
+			MachineSecrets:    props.Secrets.MachineSecrets,
+			ClusterEndpoint:   endpoint,
+			MachineType:       pulumi.String(role),
+			TalosVersion:      talosVersion,
+			KubernetesVersion: kubernetesVersion,
+			ConfigPatches:     append(append(pulumi.StringArray{}, outputPatches...), pulumi.ToStringArray(patches)...),
+		},
+		)
+		return &cfg
+	}
+
+	networkPatch, err := clusterNetworkPatch(conf.AddressSpace)
+	if err != nil {
+		return MachineConfigs{}, err
+	}
+
+	var installerPatch []string
+	if props.InstallerImage != "" {
+		patch, err := json.Marshal(map[string]interface{}{
+			"machine": map[string]interface{}{"install": map[string]string{"image": props.InstallerImage}},
+		})
+		if err != nil {
+			return MachineConfigs{}, fmt.Errorf("failed to build installer image config patch: %w", err)
+		}
+		installerPatch = []string{string(patch)}
+	}
+
+	configs := MachineConfigs{
+		Pools: make(map[string]*machine.GetConfigurationResultOutput, len(conf.NodePools)),
+		Nodes: make(map[string]*machine.GetConfigurationResultOutput),
+	}
+	for _, pool := range conf.NodePools {
+		labelPatches, err := nodePoolPatches(pool)
+		if err != nil {
+			return MachineConfigs{}, err
+		}
+		// Patches are applied in the order global, role, node pool and node
+		patches := append([]string{networkPatch}, installerPatch...)
+		patches = append(patches, conf.ConfigPatches.Global...)
+		patches = append(patches, conf.ConfigPatches.Roles[pool.Role]...)
+		patches = append(patches, labelPatches...)
+		patches = append(patches, pool.ConfigPatches...)
+		configs.Pools[pool.Name] = getConfig(pool.Role, patches)
+
+		for i := 0; i < pool.Count; i++ {
+			nodePatches, ok := conf.ConfigPatches.Nodes[pool.NodeName(i)]
+			if !ok {
+				continue
+			}
+			configs.Nodes[pool.NodeName(i)] = getConfig(pool.Role, append(append([]string{}, patches...), nodePatches...))
+		}
+	}
+
+	return configs, nil
 }
 
-func GetMachineConfiguration(ctx *pulumi.Context, props CommonProps) MachineConfigs {
-	endpoint := props.PublicIp.ToStringPtrOutput().ApplyT(func(ip *string) string {
-		return fmt.Sprintf("https://%s:6443", *ip)
+// clusterNetworkPatch makes the pod and service subnets of the Talos config match the configured address space.
+// It is a JSON6902 patch as strategic merge patches would append to the default subnets.
+func clusterNetworkPatch(space helpers.AddressSpace) (string, error) {
+	patch, err := json.Marshal([]map[string]interface{}{
+		{"op": "replace", "path": "/cluster/network/podSubnets", "value": space.PodCidrs},
+		{"op": "replace", "path": "/cluster/network/serviceSubnets", "value": space.ServiceCidrs},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to build cluster network config patch: %w", err)
+	}
+
+	return string(patch), nil
+}
+
+// certSansPatch adds the endpoint domain and load balancer IPs to the certificates of both the Talos
+// and the Kubernetes API, so either can be reached through the load balancer by name or address.
+func certSansPatch(conf helpers.CustomConfig, props CommonProps) pulumi.StringOutput {
+	ips := []interface{}{props.ApiIp}
+	if conf.AddressSpace.DualStack {
+		ips = append(ips, props.ApiIpV6)
+	}
+	return pulumi.All(ips...).ApplyT(func(args []interface{}) (string, error) {
+		sans := make([]string, 0, len(args)+1)
+		if conf.EndpointDomain != "" {
+			sans = append(sans, conf.EndpointDomain)
+		}
+		for _, ip := range args {
+			if ip, ok := ip.(*string); ok && ip != nil {
+				sans = append(sans, *ip)
+			}
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"machine": map[string]interface{}{"certSANs": sans},
+			"cluster": map[string]interface{}{"apiServer": map[string]interface{}{"certSANs": sans}},
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to build cert SANs config patch: %w", err)
+		}
+		return string(patch), nil
 	}).(pulumi.StringOutput)
-	control := machine.GetConfigurationOutput(ctx, machine.GetConfigurationOutputArgs{
-		ClusterName:     pulumi.String(props.ClusterName),
-		MachineSecrets:  props.Secrets.MachineSecrets,
-		ClusterEndpoint: endpoint,
-		MachineType:     pulumi.String("controlplane"),
-	},
-	)
-	worker := machine.GetConfigurationOutput(ctx, machine.GetConfigurationOutputArgs{
-		ClusterName:     pulumi.String(props.ClusterName),
-		MachineSecrets:  props.Secrets.MachineSecrets,
-		ClusterEndpoint: endpoint,
-		MachineType:     pulumi.String("worker"),
-	},
-	)
-	return MachineConfigs{
-		Controlplane: &control,
-		Worker:       &worker,
+}
+
+// nodePoolPatches turns the labels and taints of a node pool into Talos config patches
+func nodePoolPatches(pool helpers.NodePool) ([]string, error) {
+	if len(pool.Labels) == 0 && len(pool.Taints) == 0 {
+		return nil, nil
+	}
+
+	machineCfg := map[string]interface{}{}
+	if len(pool.Labels) > 0 {
+		machineCfg["nodeLabels"] = pool.Labels
+	}
+	if len(pool.Taints) > 0 {
+		machineCfg["nodeTaints"] = pool.Taints
+	}
+	// JSON is valid YAML, so the result is accepted as a strategic merge patch
+	patch, err := json.Marshal(map[string]interface{}{"machine": machineCfg})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build config patch for node pool %s: %w", pool.Name, err)
+	}
+
+	return []string{string(patch)}, nil
+}
+
+// Bootstrap bootstraps etcd on the given control plane node once the nodes and the endpoint DNS records
+// it depends on exist. Being a resource, the bootstrap only happens once and later updates are no-ops.
+func Bootstrap(ctx *pulumi.Context, props CommonProps, node pulumi.StringInput, computeResources ComputeResources, dnsRecords []*network.RecordSet) (*machine.Bootstrap, error) {
+	dependsOn := make([]pulumi.Resource, 0, len(computeResources.Nodes)+len(computeResources.ScaleSets)+len(dnsRecords))
+	for _, n := range computeResources.Nodes {
+		dependsOn = append(dependsOn, n)
+	}
+	for _, s := range computeResources.ScaleSets {
+		dependsOn = append(dependsOn, s)
+	}
+	for _, r := range dnsRecords {
+		dependsOn = append(dependsOn, r)
+	}
+
+	return machine.NewBootstrap(ctx, "bootstrap", &machine.BootstrapArgs{
+		ClientConfiguration: machine.ClientConfigurationArgs{
+			CaCertificate:     props.Secrets.ClientConfiguration.CaCertificate(),
+			ClientCertificate: props.Secrets.ClientConfiguration.ClientCertificate(),
+			ClientKey:         props.Secrets.ClientConfiguration.ClientKey(),
+		},
+		Node: node,
+	}, pulumi.DependsOn(dependsOn))
+}
+
+type ApplyMachineConfigsParams struct {
+	MachineConfigs MachineConfigs
+	// NodeIps holds the private IPs of the VMs of every node pool, keyed by pool name and ordered by node index
+	NodeIps map[string][]pulumi.StringPtrOutput
+	// Nodes holds the VMs of every node pool like NodeIps, configs are only applied once their VM is created or updated
+	Nodes     map[string][]*compute.VirtualMachine
+	Bootstrap *machine.Bootstrap
+}
+
+// ApplyMachineConfigs keeps the machine configs of existing VMs up to date, which only read their custom data on
+// first boot. Configs are applied through the Talos API of the bootstrapped node, which proxies to the private IPs
+// of the nodes. Control plane nodes are applied to one at a time, so changes that restart etcd or the control plane
+// components never hit all of them at once, workers follow in batches of cluster:upgrade workerBatchSize. Scale set
+// instances aren't covered, new instances get the changed config through the scale set model. The returned IDs
+// resolve once every config was applied.
+func ApplyMachineConfigs(ctx *pulumi.Context, props CommonProps, params ApplyMachineConfigsParams) (pulumi.StringArray, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := pulumi.StringArray{}
+	applyConfig := func(pool helpers.NodePool, i int, dependsOn []pulumi.Resource) (pulumi.Resource, error) {
+		apply, err := machine.NewConfigurationApply(ctx, fmt.Sprintf("%s-config", pool.NodeName(i)), &machine.ConfigurationApplyArgs{
+			ClientConfiguration: machine.ClientConfigurationArgs{
+				CaCertificate:     props.Secrets.ClientConfiguration.CaCertificate(),
+				ClientCertificate: props.Secrets.ClientConfiguration.ClientCertificate(),
+				ClientKey:         props.Secrets.ClientConfiguration.ClientKey(),
+			},
+			MachineConfigurationInput: params.MachineConfigs.ForNode(pool, i),
+			Node:                      params.NodeIps[pool.Name][i].Elem(),
+			// Going through the bootstrap outputs makes sure configs are only applied after bootstrapping
+			Endpoint: params.Bootstrap.Endpoint,
+		}, pulumi.DependsOn(append([]pulumi.Resource{params.Nodes[pool.Name][i]}, dependsOn...)))
+		if err != nil {
+			return nil, err
+		}
+		applied = append(applied, apply.ID().ToStringOutput())
+		return apply, nil
 	}
+
+	var previous []pulumi.Resource
+	for _, pool := range conf.NodePools {
+		if pool.ScaleSet || !pool.IsControlplane() {
+			continue
+		}
+		for i := 0; i < pool.Count; i++ {
+			apply, err := applyConfig(pool, i, previous)
+			if err != nil {
+				return nil, err
+			}
+			previous = []pulumi.Resource{apply}
+		}
+	}
+	var workers []func(dependsOn []pulumi.Resource) (pulumi.Resource, error)
+	for _, pool := range conf.NodePools {
+		if pool.ScaleSet || pool.IsControlplane() {
+			continue
+		}
+		for i := 0; i < pool.Count; i++ {
+			workers = append(workers, func(dependsOn []pulumi.Resource) (pulumi.Resource, error) {
+				return applyConfig(pool, i, dependsOn)
+			})
+		}
+	}
+	// Every batch waits for the previous one, the first for the last control plane node
+	for _, batch := range batches(workers, conf.Upgrade.WorkerBatchSize) {
+		applies := make([]pulumi.Resource, len(batch))
+		for i, worker := range batch {
+			applies[i], err = worker(previous)
+			if err != nil {
+				return nil, err
+			}
+		}
+		previous = applies
+	}
+	return applied, nil
+}
+
+// batches splits items into consecutive batches of the given size, the last one holding the rest
+func batches[T any](items []T, size int) [][]T {
+	var result [][]T
+	for start := 0; start < len(items); start += size {
+		result = append(result, items[start:min(start+size, len(items))])
+	}
+	return result
+}
+
+// GetKubeconfig retrieves the admin kubeconfig from the bootstrapped control plane node.
+// The kubeconfig points at the cluster endpoint, i.e. the endpoint domain or the load balancer IP.
+func GetKubeconfig(ctx *pulumi.Context, props CommonProps, bootstrap *machine.Bootstrap) pulumi.StringOutput {
+	res := talosCluster.GetKubeconfigOutput(ctx, talosCluster.GetKubeconfigOutputArgs{
+		ClientConfiguration: talosCluster.GetKubeconfigClientConfigurationArgs{
+			CaCertificate:     props.Secrets.ClientConfiguration.CaCertificate(),
+			ClientCertificate: props.Secrets.ClientConfiguration.ClientCertificate(),
+			ClientKey:         props.Secrets.ClientConfiguration.ClientKey(),
+		},
+		// Going through the bootstrap outputs makes sure the kubeconfig is only requested after bootstrapping
+		Node:     bootstrap.Node,
+		Endpoint: bootstrap.Endpoint,
+	})
+	return pulumi.ToSecret(res.KubeconfigRaw()).(pulumi.StringOutput)
 }
@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"talos-azure/helpers"
+	"talos-azure/internal/testutil"
+	"testing"
+
+	compute "github.com/pulumi/pulumi-azure-native-sdk/compute/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/machine"
+)
+
+// recordingMocks keeps the dependencies of every resource and the arguments of every invoke
+type recordingMocks struct {
+	testutil.Mocks
+	mu           sync.Mutex
+	dependencies map[string][]string
+	calls        map[string][]resource.PropertyMap
+}
+
+func newRecordingMocks() *recordingMocks {
+	return &recordingMocks{dependencies: map[string][]string{}, calls: map[string][]resource.PropertyMap{}}
+}
+
+func (m *recordingMocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var dependencies []string
+	for _, urn := range args.RegisterRPC.GetDependencies() {
+		dependencies = append(dependencies, urn[strings.LastIndex(urn, "::")+2:])
+	}
+	slices.Sort(dependencies)
+	m.dependencies[args.Name] = dependencies
+	return m.Mocks.NewResource(args)
+}
+
+func (m *recordingMocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls[args.Token] = append(m.calls[args.Token], args.Args)
+	return m.Mocks.Call(args)
+}
+
+func TestApplyMachineConfigs(t *testing.T) {
+	values := testutil.RequiredConfig()
+	values["cluster:workers"] = "3"
+	values["cluster:upgrade"] = `{"workerBatchSize": 2}`
+	mocks := newRecordingMocks()
+
+	testutil.WithMocks(t, values, mocks, func(ctx *pulumi.Context) error {
+		conf, err := helpers.GetConfig(ctx)
+		if err != nil {
+			return err
+		}
+		secrets, err := machine.NewSecrets(ctx, "secrets", nil)
+		if err != nil {
+			return err
+		}
+		bootstrap, err := machine.NewBootstrap(ctx, "bootstrap", &machine.BootstrapArgs{
+			ClientConfiguration: machine.ClientConfigurationArgs{
+				CaCertificate:     pulumi.String("ca"),
+				ClientCertificate: pulumi.String("crt"),
+				ClientKey:         pulumi.String("key"),
+			},
+			Node: pulumi.String("10.0.0.4"),
+		})
+		if err != nil {
+			return err
+		}
+		props := CommonProps{ClusterName: "talos", ApiIp: pulumi.StringPtr("203.0.113.1"), Secrets: secrets}
+		machineConfigs, err := GetMachineConfiguration(ctx, props)
+		if err != nil {
+			return err
+		}
+		params := ApplyMachineConfigsParams{
+			MachineConfigs: machineConfigs,
+			NodeIps:        map[string][]pulumi.StringPtrOutput{},
+			Nodes:          map[string][]*compute.VirtualMachine{},
+			Bootstrap:      bootstrap,
+		}
+		for _, pool := range conf.NodePools {
+			for i := 0; i < pool.Count; i++ {
+				vm, err := compute.NewVirtualMachine(ctx, pool.NodeName(i)+"-vm", &compute.VirtualMachineArgs{
+					ResourceGroupName: pulumi.String("talos"),
+				})
+				if err != nil {
+					return err
+				}
+				params.Nodes[pool.Name] = append(params.Nodes[pool.Name], vm)
+				params.NodeIps[pool.Name] = append(params.NodeIps[pool.Name], pulumi.StringPtr("10.0.0.4").ToStringPtrOutput())
+			}
+		}
+		_, err = ApplyMachineConfigs(ctx, props, params)
+		return err
+	})
+
+	// Control plane nodes go one at a time, the workers follow in batches of two. Dependencies through inputs
+	// such as the bootstrap endpoint are left out.
+	want := map[string][]string{
+		"control-0-config": {"control-0-vm"},
+		"control-1-config": {"control-0-config", "control-1-vm"},
+		"control-2-config": {"control-1-config", "control-2-vm"},
+		"worker-0-config":  {"control-2-config", "worker-0-vm"},
+		"worker-1-config":  {"control-2-config", "worker-1-vm"},
+		"worker-2-config":  {"worker-0-config", "worker-1-config", "worker-2-vm"},
+	}
+	for name, dependencies := range want {
+		got := slices.DeleteFunc(mocks.dependencies[name], func(dependency string) bool {
+			return !strings.HasSuffix(dependency, "-config") && !strings.HasSuffix(dependency, "-vm")
+		})
+		if !slices.Equal(got, dependencies) {
+			t.Errorf("dependencies of %s = %v, want %v", name, got, dependencies)
+		}
+	}
+}
+
+func TestGetMachineConfigurationVersions(t *testing.T) {
+	tests := []struct {
+		name                  string
+		props                 CommonProps
+		wantTalosVersion      string
+		wantKubernetesVersion string
+	}{
+		{"defaults", CommonProps{}, "", ""},
+		{"pinned", CommonProps{TalosVersion: "1.7.6", KubernetesVersion: "1.30.3"}, "v1.7.6", "1.30.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mocks := newRecordingMocks()
+			testutil.WithMocks(t, testutil.RequiredConfig(), mocks, func(ctx *pulumi.Context) error {
+				secrets, err := machine.NewSecrets(ctx, "secrets", nil)
+				if err != nil {
+					return err
+				}
+				props := tt.props
+				props.ClusterName = "talos"
+				props.Secrets = secrets
+				props.ApiIp = pulumi.StringPtr("203.0.113.1")
+				_, err = GetMachineConfiguration(ctx, props)
+				return err
+			})
+
+			calls := mocks.calls["talos:machine/getConfiguration:getConfiguration"]
+			if len(calls) != 2 {
+				t.Fatalf("got %d machine configs, want one per pool", len(calls))
+			}
+			for _, args := range calls {
+				if got := args["talosVersion"]; got.IsString() != (tt.wantTalosVersion != "") || (got.IsString() && got.StringValue() != tt.wantTalosVersion) {
+					t.Errorf("talosVersion = %v, want %q", got, tt.wantTalosVersion)
+				}
+				if got := args["kubernetesVersion"]; got.IsString() != (tt.wantKubernetesVersion != "") || (got.IsString() && got.StringValue() != tt.wantKubernetesVersion) {
+					t.Errorf("kubernetesVersion = %v, want %q", got, tt.wantKubernetesVersion)
+				}
+			}
+		})
+	}
+}
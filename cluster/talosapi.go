@@ -0,0 +1,209 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/safe"
+	machineapi "github.com/siderolabs/talos/pkg/machinery/api/machine"
+	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
+	clientconfig "github.com/siderolabs/talos/pkg/machinery/client/config"
+	"github.com/siderolabs/talos/pkg/machinery/config/encoder"
+	"github.com/siderolabs/talos/pkg/machinery/config/types/v1alpha1"
+	talosresources "github.com/siderolabs/talos/pkg/machinery/resources/cluster"
+	configresources "github.com/siderolabs/talos/pkg/machinery/resources/config"
+)
+
+// pollInterval is how often waitFor repeats its check
+const pollInterval = 10 * time.Second
+
+// talosNode is a node resolved to its address, as used for calls against the Talos API
+type talosNode struct {
+	name         string
+	ip           string
+	controlplane bool
+	// spot is set for instances of spot scale set pools, they are probed before being health checked or upgraded
+	spot bool
+	// evicted is set for spot VMs that Azure deallocated
+	evicted bool
+}
+
+func (n talosNode) role() string {
+	if n.controlplane {
+		return "controlplane"
+	}
+	return "worker"
+}
+
+// newTalosClient connects to the Talos API through the endpoints of the talosconfig of the cluster
+func newTalosClient(ctx context.Context, talosConfig string) (*talosclient.Client, error) {
+	cfg, err := clientconfig.FromString(talosConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse talosconfig: %w", err)
+	}
+	c, err := talosclient.New(ctx, talosclient.WithConfig(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Talos API client: %w", err)
+	}
+	return c, nil
+}
+
+// talosVersion returns the Talos version the node runs, e.g. v1.7.6
+func talosVersion(ctx context.Context, c *talosclient.Client, ip string) (string, error) {
+	resp, err := c.Version(talosclient.WithNode(ctx, ip))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Messages) == 0 || resp.Messages[0].Version == nil {
+		return "", fmt.Errorf("node %s returned no version", ip)
+	}
+	return resp.Messages[0].Version.Tag, nil
+}
+
+// nodeStatus describes the Talos version and the health of the services of the node
+func nodeStatus(ctx context.Context, c *talosclient.Client, node talosNode) string {
+	version, err := talosVersion(ctx, c, node.ip)
+	if err != nil {
+		return fmt.Sprintf("unreachable: %s", err)
+	}
+	resp, err := c.ServiceList(talosclient.WithNode(ctx, node.ip))
+	if err != nil {
+		return fmt.Sprintf("Talos %s, failed to list services: %s", version, err)
+	}
+
+	var unhealthy []string
+	for _, message := range resp.Messages {
+		for _, service := range message.Services {
+			failed := service.State == "Failed"
+			if service.Health != nil && !service.Health.Unknown && !service.Health.Healthy {
+				failed = true
+			}
+			if failed {
+				unhealthy = append(unhealthy, fmt.Sprintf("%s (%s)", service.Id, strings.ToLower(service.State)))
+			}
+		}
+	}
+	if len(unhealthy) > 0 {
+		return fmt.Sprintf("Talos %s, unhealthy services: %s", version, strings.Join(unhealthy, ", "))
+	}
+	return fmt.Sprintf("Talos %s, healthy", version)
+}
+
+// scaleSetNodes lists the scale set instances that joined the cluster, as discovered by Talos. Instances are
+// matched by their hostname, which starts with the name of their pool. Known nodes are skipped, so VMs of pools
+// sharing the prefix aren't picked up.
+func scaleSetNodes(ctx context.Context, c *talosclient.Client, controlIp string, pools []ScaleSetPool, known []talosNode) ([]talosNode, error) {
+	if len(pools) == 0 {
+		return nil, nil
+	}
+	members, err := safe.StateListAll[*talosresources.Member](talosclient.WithNode(ctx, controlIp), c.COSI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cluster members: %w", err)
+	}
+	knownNames := make(map[string]bool, len(known))
+	for _, node := range known {
+		knownNames[node.name] = true
+	}
+
+	var nodes []talosNode
+	for it := members.Iterator(); it.Next(); {
+		spec := it.Value().TypedSpec()
+		if knownNames[spec.Hostname] || len(spec.Addresses) == 0 {
+			continue
+		}
+		for _, pool := range pools {
+			if strings.HasPrefix(spec.Hostname, pool.Name) {
+				nodes = append(nodes, talosNode{name: spec.Hostname, ip: memberIp(spec).String(), spot: pool.Spot})
+				break
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// memberIp prefers the IPv4 address of dual-stack members
+func memberIp(spec *talosresources.MemberSpec) netip.Addr {
+	for _, addr := range spec.Addresses {
+		if addr.Is4() {
+			return addr
+		}
+	}
+	return spec.Addresses[0]
+}
+
+// waitFor repeats check until it succeeds, returning its last error once the timeout passed
+func waitFor(ctx context.Context, timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// etcdHealthy checks that etcd answers on every control plane node
+func etcdHealthy(ctx context.Context, c *talosclient.Client, controlIps []string) error {
+	for _, ip := range controlIps {
+		_, err := c.EtcdStatus(talosclient.WithNode(ctx, ip))
+		if err != nil {
+			return fmt.Errorf("etcd on %s: %w", ip, err)
+		}
+	}
+	return nil
+}
+
+// upgradeTalos starts the upgrade of the node to the installer image, keeping the ephemeral partition and with
+// it the etcd data. The node reboots into the new version afterwards.
+func upgradeTalos(ctx context.Context, c *talosclient.Client, ip string, image string) error {
+	_, err := c.UpgradeWithOptions(talosclient.WithNode(ctx, ip),
+		talosclient.WithUpgradeImage(image),
+		talosclient.WithUpgradePreserve(true),
+	)
+	return err
+}
+
+// patchMachineConfig applies patch to the active machine config of the node without rebooting it. It reports
+// whether the config changed, patch returns false to leave the config untouched.
+func patchMachineConfig(ctx context.Context, c *talosclient.Client, ip string, patch func(cfg *v1alpha1.Config) bool) (bool, error) {
+	nodeCtx := talosclient.WithNode(ctx, ip)
+	active, err := safe.StateGetByID[*configresources.MachineConfig](nodeCtx, c.COSI, configresources.V1Alpha1ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to read machine config: %w", err)
+	}
+	changed := false
+	patched, err := active.Provider().PatchV1Alpha1(func(cfg *v1alpha1.Config) error {
+		changed = patch(cfg)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to patch machine config: %w", err)
+	}
+	if !changed {
+		return false, nil
+	}
+
+	data, err := patched.EncodeBytes(encoder.WithComments(encoder.CommentsDisabled))
+	if err != nil {
+		return false, fmt.Errorf("failed to encode machine config: %w", err)
+	}
+	_, err = c.ApplyConfiguration(nodeCtx, &machineapi.ApplyConfigurationRequest{
+		Data: data,
+		Mode: machineapi.ApplyConfigurationRequest_NO_REBOOT,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to apply machine config: %w", err)
+	}
+	return true, nil
+}
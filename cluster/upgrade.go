@@ -0,0 +1,400 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"talos-azure/helpers"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/client"
+	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
+	"github.com/siderolabs/talos/pkg/machinery/config/types/v1alpha1"
+	"github.com/siderolabs/talos/pkg/machinery/constants"
+)
+
+type UpgradeTalosParams struct {
+	ClientCfg *client.GetConfigurationResultOutput
+	// Nodes are upgraded in the given order, control plane nodes first
+	Nodes []HealthCheckNode
+	// ScaleSetPools are upgraded along with the workers
+	ScaleSetPools []ScaleSetPool
+	// Version is the resolved cluster:talos-version nodes are upgraded to
+	Version string
+	// InstallerImage is the image nodes are upgraded with, the official installer of the Talos version when empty
+	InstallerImage string
+	// ReadyAfter delays the upgrade until the given output resolves, e.g. the health check
+	ReadyAfter pulumi.Input
+}
+
+// UpgradeTalos upgrades every node running another Talos version in place through the Talos API, keeping the
+// etcd data. Control plane nodes are upgraded one at a time with etcd being checked in between, workers and scale
+// set instances follow in batches of cluster:upgrade workerBatchSize. Nodes already running the version are
+// skipped, so a failed upgrade continues where it stopped on the next update. Evicted spot nodes are skipped as
+// well and upgraded by the first update after they were started again. The returned output maps every node to its
+// version and has to be exported for a failed upgrade to fail the update.
+func UpgradeTalos(ctx *pulumi.Context, params UpgradeTalosParams) (pulumi.StringMapOutput, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return pulumi.StringMapOutput{}, err
+	}
+	timeout, err := time.ParseDuration(conf.Upgrade.Timeout)
+	if err != nil {
+		return pulumi.StringMapOutput{}, err
+	}
+	target := "v" + params.Version
+	image := params.InstallerImage
+	if image == "" {
+		image = fmt.Sprintf("ghcr.io/siderolabs/installer:%s", target)
+	}
+
+	inputs := append([]interface{}{params.ReadyAfter, params.ClientCfg.TalosConfig()}, nodeInputs(params.Nodes)...)
+	return pulumi.All(inputs...).ApplyT(func(args []interface{}) (map[string]string, error) {
+		versions := make(map[string]string, len(params.Nodes))
+		if ctx.DryRun() {
+			for _, node := range params.Nodes {
+				versions[node.Name] = target
+			}
+			return versions, nil
+		}
+
+		talosClient, err := newTalosClient(ctx.Context(), args[1].(string))
+		if err != nil {
+			return nil, err
+		}
+		defer talosClient.Close()
+		controlNodes, workerNodes, evicted, err := upgradeNodes(ctx, talosClient, params.Nodes, args[2:], params.ScaleSetPools)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range evicted {
+			versions[node.name] = "evicted"
+		}
+
+		upgrader := nodeUpgrader{ctx, talosClient, image, target, timeout}
+		for _, node := range controlNodes {
+			upgraded, err := upgrader.upgrade(node)
+			if err != nil {
+				return nil, err
+			}
+			if upgraded {
+				err = waitFor(ctx.Context(), timeout, func() error {
+					return etcdHealthy(ctx.Context(), talosClient, controlIps(controlNodes))
+				})
+				if err != nil {
+					return nil, fmt.Errorf("etcd did not become healthy after upgrading %s: %w", node.name, err)
+				}
+			}
+		}
+		for _, batch := range batches(workerNodes, conf.Upgrade.WorkerBatchSize) {
+			err = upgrader.upgradeBatch(batch)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, node := range append(controlNodes, workerNodes...) {
+			versions[node.name] = target
+		}
+		return versions, nil
+	}).(pulumi.StringMapOutput), nil
+}
+
+type UpgradeKubernetesParams struct {
+	ClientCfg     *client.GetConfigurationResultOutput
+	Nodes         []HealthCheckNode
+	ScaleSetPools []ScaleSetPool
+	// Version is the Kubernetes version to upgrade to, the upgrade is skipped when empty
+	Version string
+	// Kubeconfig is the admin kubeconfig, used to wait for the components and to update kube-proxy
+	Kubeconfig pulumi.StringOutput
+	// ReadyAfter delays the upgrade until the given output resolves, e.g. the Talos upgrade
+	ReadyAfter pulumi.Input
+}
+
+// UpgradeKubernetes rolls the cluster to another Kubernetes version the way talosctl upgrade-k8s does, through the
+// Talos and Kubernetes APIs. The images of the control plane components are updated in the machine config of one
+// control plane node after another, waiting for the static pods to become ready in between. kube-proxy, which
+// Talos doesn't update after bootstrapping, follows and the kubelets of all nodes come last. Machine configs
+// already referencing the images are left untouched, so a failed upgrade is continued by the next update. The
+// returned output has to be exported for a failed upgrade to fail the update.
+func UpgradeKubernetes(ctx *pulumi.Context, params UpgradeKubernetesParams) (pulumi.StringOutput, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+	timeout, err := time.ParseDuration(conf.Upgrade.Timeout)
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	inputs := append([]interface{}{params.ReadyAfter, params.ClientCfg.TalosConfig(), params.Kubeconfig}, nodeInputs(params.Nodes)...)
+	result := pulumi.All(inputs...).ApplyT(func(args []interface{}) (string, error) {
+		if params.Version == "" {
+			return "no upgrade required", nil
+		}
+		if ctx.DryRun() {
+			return "skipped during preview", nil
+		}
+
+		talosClient, err := newTalosClient(ctx.Context(), args[1].(string))
+		if err != nil {
+			return "", err
+		}
+		defer talosClient.Close()
+		kube, err := newKubeClient(args[2].(string))
+		if err != nil {
+			return "", err
+		}
+		controlNodes, workerNodes, _, err := upgradeNodes(ctx, talosClient, params.Nodes, args[3:], params.ScaleSetPools)
+		if err != nil {
+			return "", err
+		}
+
+		upgrader := kubernetesUpgrader{ctx, talosClient, kube, "v" + params.Version, timeout}
+		_ = ctx.Log.Info(fmt.Sprintf("upgrading Kubernetes to %s", upgrader.version), nil)
+		for _, node := range controlNodes {
+			err = upgrader.upgradeControlPlane(node)
+			if err != nil {
+				return "", err
+			}
+		}
+		if runsKubeProxy(conf) {
+			err = upgrader.upgradeKubeProxy()
+			if err != nil {
+				return "", err
+			}
+		}
+		for _, node := range append(controlNodes, workerNodes...) {
+			err = upgrader.upgradeKubelet(node)
+			if err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("upgraded to %s", upgrader.version), nil
+	})
+	// The result doesn't contain anything of the kubeconfig it was derived from
+	return pulumi.Unsecret(result).(pulumi.StringOutput), nil
+}
+
+// runsKubeProxy reports whether the cluster was bootstrapped with kube-proxy, Cilium replaces it
+func runsKubeProxy(conf helpers.CustomConfig) bool {
+	return conf.Cni != helpers.CniCilium
+}
+
+// upgradeNodes resolves the nodes from the resolved nodeInputs and adds the scale set instances that joined the
+// cluster as workers. Evicted spot nodes are returned separately.
+func upgradeNodes(ctx *pulumi.Context, c *talosclient.Client, nodes []HealthCheckNode, args []interface{}, scaleSetPools []ScaleSetPool) ([]talosNode, []talosNode, []talosNode, error) {
+	var controlNodes, workerNodes []talosNode
+	for _, node := range resolveNodes(nodes, args) {
+		if node.controlplane {
+			controlNodes = append(controlNodes, node)
+		} else {
+			workerNodes = append(workerNodes, node)
+		}
+	}
+	if len(controlNodes) == 0 {
+		return nil, nil, nil, fmt.Errorf("no control plane node to upgrade the cluster through")
+	}
+
+	scaleSetNodes, err := scaleSetNodes(ctx.Context(), c, controlNodes[0].ip, scaleSetPools, append(controlNodes, workerNodes...))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to discover scale set nodes: %w", err)
+	}
+	workerNodes, evicted := splitEvicted(append(workerNodes, scaleSetNodes...), answersWithin(ctx.Context(), c))
+	for _, node := range evicted {
+		_ = ctx.Log.Warn(fmt.Sprintf("skipping %s, the spot instance is evicted", node.name), nil)
+	}
+	return controlNodes, workerNodes, evicted, nil
+}
+
+type nodeUpgrader struct {
+	ctx     *pulumi.Context
+	client  *talosclient.Client
+	image   string
+	target  string
+	timeout time.Duration
+}
+
+// upgrade upgrades the node unless it already runs the target version and waits until it rebooted into it
+func (u nodeUpgrader) upgrade(node talosNode) (bool, error) {
+	current, err := talosVersion(u.ctx.Context(), u.client, node.ip)
+	if err != nil {
+		return false, fmt.Errorf("failed to get Talos version of %s: %w", node.name, err)
+	}
+	if current == u.target {
+		return false, nil
+	}
+
+	_ = u.ctx.Log.Info(fmt.Sprintf("upgrading %s from %s to %s", node.name, current, u.target), nil)
+	err = upgradeTalos(u.ctx.Context(), u.client, node.ip, u.image)
+	if err != nil {
+		return false, fmt.Errorf("failed to upgrade %s: %w", node.name, err)
+	}
+	// The node is unreachable while it reboots, errors only count once the timeout passed
+	err = waitFor(u.ctx.Context(), u.timeout, func() error {
+		version, err := talosVersion(u.ctx.Context(), u.client, node.ip)
+		if err != nil {
+			return err
+		}
+		if version != u.target {
+			return fmt.Errorf("node still runs %s", version)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("%s did not come up with %s within %s: %w", node.name, u.target, u.timeout, err)
+	}
+	return true, nil
+}
+
+func (u nodeUpgrader) upgradeBatch(nodes []talosNode) error {
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node talosNode) {
+			defer wg.Done()
+			_, errs[i] = u.upgrade(node)
+		}(i, node)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+type kubernetesUpgrader struct {
+	ctx     *pulumi.Context
+	talos   *talosclient.Client
+	kube    *kubeClient
+	version string
+	timeout time.Duration
+}
+
+// upgradeControlPlane updates the images of the control plane components of the node and waits for their static
+// pods to run them
+func (u kubernetesUpgrader) upgradeControlPlane(node talosNode) error {
+	images := map[string]string{
+		"kube-apiserver":          fmt.Sprintf("%s:%s", constants.KubernetesAPIServerImage, u.version),
+		"kube-controller-manager": fmt.Sprintf("%s:%s", constants.KubernetesControllerManagerImage, u.version),
+		"kube-scheduler":          fmt.Sprintf("%s:%s", constants.KubernetesSchedulerImage, u.version),
+	}
+	changed, err := patchMachineConfig(u.ctx.Context(), u.talos, node.ip, func(cfg *v1alpha1.Config) bool {
+		if cfg.ClusterConfig == nil {
+			cfg.ClusterConfig = &v1alpha1.ClusterConfig{}
+		}
+		cluster := cfg.ClusterConfig
+		if cluster.APIServerConfig == nil {
+			cluster.APIServerConfig = &v1alpha1.APIServerConfig{}
+		}
+		if cluster.ControllerManagerConfig == nil {
+			cluster.ControllerManagerConfig = &v1alpha1.ControllerManagerConfig{}
+		}
+		if cluster.SchedulerConfig == nil {
+			cluster.SchedulerConfig = &v1alpha1.SchedulerConfig{}
+		}
+		// The proxy image is only read when bootstrapping, it is updated to keep the config consistent
+		if cluster.ProxyConfig == nil {
+			cluster.ProxyConfig = &v1alpha1.ProxyConfig{}
+		}
+		changed := false
+		for field, image := range map[*string]string{
+			&cluster.APIServerConfig.ContainerImage:         images["kube-apiserver"],
+			&cluster.ControllerManagerConfig.ContainerImage: images["kube-controller-manager"],
+			&cluster.SchedulerConfig.ContainerImage:         images["kube-scheduler"],
+			&cluster.ProxyConfig.ContainerImage:             fmt.Sprintf("%s:%s", constants.KubeProxyImage, u.version),
+		} {
+			changed = setImage(field, image) || changed
+		}
+		return changed
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update the control plane images of %s: %w", node.name, err)
+	}
+	if changed {
+		_ = u.ctx.Log.Info(fmt.Sprintf("upgrading the control plane components of %s to %s", node.name, u.version), nil)
+	}
+
+	err = waitFor(u.ctx.Context(), u.timeout, func() error {
+		for component, image := range images {
+			err := u.kube.podReady(u.ctx.Context(), "kube-system", fmt.Sprintf("%s-%s", component, node.name), image)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("control plane components of %s did not become ready within %s: %w", node.name, u.timeout, err)
+	}
+	return nil
+}
+
+// upgradeKubeProxy updates the image of the kube-proxy DaemonSet and waits for the rollout, clusters running
+// without kube-proxy are skipped
+func (u kubernetesUpgrader) upgradeKubeProxy() error {
+	path := "/apis/apps/v1/namespaces/kube-system/daemonsets/kube-proxy"
+	err := u.kube.get(u.ctx.Context(), path, nil)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_ = u.ctx.Log.Info(fmt.Sprintf("upgrading kube-proxy to %s", u.version), nil)
+	err = u.kube.patch(u.ctx.Context(), path, map[string]interface{}{
+		"spec": map[string]interface{}{"template": map[string]interface{}{"spec": map[string]interface{}{
+			"containers": []map[string]string{
+				{"name": "kube-proxy", "image": fmt.Sprintf("%s:%s", constants.KubeProxyImage, u.version)},
+			},
+		}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update kube-proxy: %w", err)
+	}
+	err = waitFor(u.ctx.Context(), u.timeout, func() error {
+		return u.kube.daemonSetRolledOut(u.ctx.Context(), "kube-system", "kube-proxy")
+	})
+	if err != nil {
+		return fmt.Errorf("kube-proxy did not roll out within %s: %w", u.timeout, err)
+	}
+	return nil
+}
+
+// upgradeKubelet updates the kubelet image of the node and waits until it reports the node ready with the version
+func (u kubernetesUpgrader) upgradeKubelet(node talosNode) error {
+	changed, err := patchMachineConfig(u.ctx.Context(), u.talos, node.ip, func(cfg *v1alpha1.Config) bool {
+		if cfg.MachineConfig == nil {
+			cfg.MachineConfig = &v1alpha1.MachineConfig{}
+		}
+		if cfg.MachineConfig.MachineKubelet == nil {
+			cfg.MachineConfig.MachineKubelet = &v1alpha1.KubeletConfig{}
+		}
+		return setImage(&cfg.MachineConfig.MachineKubelet.KubeletImage, fmt.Sprintf("%s:%s", constants.KubeletImage, u.version))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update the kubelet image of %s: %w", node.name, err)
+	}
+	if changed {
+		_ = u.ctx.Log.Info(fmt.Sprintf("upgrading the kubelet of %s to %s", node.name, u.version), nil)
+	}
+
+	err = waitFor(u.ctx.Context(), u.timeout, func() error {
+		return u.kube.nodeReady(u.ctx.Context(), node.name, u.version)
+	})
+	if err != nil {
+		return fmt.Errorf("kubelet of %s did not become ready within %s: %w", node.name, u.timeout, err)
+	}
+	return nil
+}
+
+// setImage sets the image and reports whether it changed
+func setImage(field *string, image string) bool {
+	if *field == image {
+		return false
+	}
+	*field = image
+	return true
+}
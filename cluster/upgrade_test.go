@@ -0,0 +1,71 @@
+package cluster
+
+import (
+	"slices"
+	"talos-azure/helpers"
+	"talos-azure/internal/testutil"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/client"
+)
+
+func TestBatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []string
+		size  int
+		want  [][]string
+	}{
+		{"no workers", nil, 2, nil},
+		{"one at a time", []string{"a", "b", "c"}, 1, [][]string{{"a"}, {"b"}, {"c"}}},
+		{"partial last batch", []string{"a", "b", "c"}, 2, [][]string{{"a", "b"}, {"c"}}},
+		{"even batches", []string{"a", "b", "c", "d"}, 2, [][]string{{"a", "b"}, {"c", "d"}}},
+		{"larger than the pool", []string{"a", "b"}, 5, [][]string{{"a", "b"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := batches(tt.items, tt.size)
+			if !slices.EqualFunc(got, tt.want, slices.Equal[[]string]) {
+				t.Errorf("batches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunsKubeProxy(t *testing.T) {
+	tests := []struct {
+		cni  string
+		want bool
+	}{
+		{helpers.CniFlannel, true},
+		{helpers.CniNone, true},
+		{helpers.CniCilium, false},
+	}
+	for _, tt := range tests {
+		if got := runsKubeProxy(helpers.CustomConfig{Cni: tt.cni}); got != tt.want {
+			t.Errorf("runsKubeProxy(%s) = %v, want %v", tt.cni, got, tt.want)
+		}
+	}
+}
+
+func TestUpgradeKubernetesWithoutVersion(t *testing.T) {
+	testutil.WithConfig(t, testutil.RequiredConfig(), func(ctx *pulumi.Context) error {
+		clientCfg := client.GetConfigurationOutput(ctx, client.GetConfigurationOutputArgs{ClusterName: pulumi.String("talos")})
+		result, err := UpgradeKubernetes(ctx, UpgradeKubernetesParams{
+			ClientCfg:  &clientCfg,
+			Kubeconfig: pulumi.String("").ToStringOutput(),
+			ReadyAfter: pulumi.String("ready"),
+		})
+		if err != nil {
+			return err
+		}
+		result.ApplyT(func(status string) error {
+			if status != "no upgrade required" {
+				t.Errorf("UpgradeKubernetes() = %q, want no upgrade", status)
+			}
+			return nil
+		})
+		return nil
+	})
+}
@@ -0,0 +1,127 @@
+package cni
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"talos-azure/helpers"
+	"text/template"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	ciliumVersion    = "1.16.1"
+	ciliumCliVersion = "v0.16.16"
+	// kubePrismPort is the port of the Talos API server proxy every node runs on localhost
+	kubePrismPort = 7445
+)
+
+//go:embed manifests/cilium-install.yaml
+var ciliumInstallManifest string
+
+// ConfigPatch returns the Talos config patch which replaces the default Flannel CNI. With cilium, kube-proxy is
+// disabled as well and Cilium is installed with kube-proxy replacement. It returns nil for flannel.
+func ConfigPatch(ctx *pulumi.Context) (pulumi.StringInput, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch conf.Cni {
+	case helpers.CniNone:
+		patch, err := json.Marshal(map[string]interface{}{
+			"cluster": map[string]interface{}{
+				"network": map[string]interface{}{"cni": map[string]string{"name": "none"}},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to build CNI config patch: %w", err)
+		}
+		return pulumi.String(patch), nil
+	case helpers.CniCilium:
+		return ciliumPatch(conf)
+	}
+	return nil, nil
+}
+
+func ciliumPatch(conf helpers.CustomConfig) (pulumi.StringInput, error) {
+	manifest, err := renderCiliumManifest(ciliumValues(conf))
+	if err != nil {
+		return nil, err
+	}
+	// JSON is valid YAML, so the result is accepted as a strategic merge patch
+	patch, err := json.Marshal(map[string]interface{}{
+		"machine": map[string]interface{}{
+			"features": map[string]interface{}{
+				"kubePrism": map[string]interface{}{"enabled": true, "port": kubePrismPort},
+			},
+		},
+		"cluster": map[string]interface{}{
+			"network": map[string]interface{}{"cni": map[string]string{"name": "none"}},
+			"proxy":   map[string]bool{"disabled": true},
+			"inlineManifests": []map[string]string{
+				{"name": "cilium-install", "contents": manifest},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build cilium config patch: %w", err)
+	}
+	return pulumi.String(patch), nil
+}
+
+// ciliumValues returns the Helm values Cilium is installed with. Without kube-proxy Cilium has to reach the API
+// server directly. It goes through KubePrism, the load balancer every node runs on localhost, as the public
+// load balancer may not allow the nodes and internal load balancers drop traffic a backend sends to itself.
+func ciliumValues(conf helpers.CustomConfig) []string {
+	values := []string{
+		"kubeProxyReplacement=true",
+		"k8sServiceHost=localhost",
+		fmt.Sprintf("k8sServicePort=%d", kubePrismPort),
+		"ipam.mode=cluster-pool",
+		// Talos mounts cgroups itself and doesn't allow loading kernel modules, so SYS_MODULE is left out
+		"cgroup.autoMount.enabled=false",
+		"cgroup.hostRoot=/sys/fs/cgroup",
+		"securityContext.capabilities.ciliumAgent={CHOWN,KILL,NET_ADMIN,NET_RAW,IPC_LOCK,SYS_ADMIN,SYS_RESOURCE,DAC_OVERRIDE,FOWNER,SETGID,SETUID}",
+		"securityContext.capabilities.cleanCiliumState={NET_ADMIN,SYS_ADMIN,SYS_RESOURCE}",
+	}
+	var ipv4Cidrs, ipv6Cidrs []string
+	for _, cidr := range conf.AddressSpace.PodCidrs {
+		if strings.Contains(cidr, ":") {
+			ipv6Cidrs = append(ipv6Cidrs, cidr)
+		} else {
+			ipv4Cidrs = append(ipv4Cidrs, cidr)
+		}
+	}
+	if len(ipv4Cidrs) > 0 {
+		values = append(values, fmt.Sprintf("ipam.operator.clusterPoolIPv4PodCIDRList={%s}", strings.Join(ipv4Cidrs, ",")))
+	}
+	if len(ipv6Cidrs) > 0 {
+		values = append(values,
+			"ipv6.enabled=true",
+			fmt.Sprintf("ipam.operator.clusterPoolIPv6PodCIDRList={%s}", strings.Join(ipv6Cidrs, ",")),
+		)
+	}
+
+	return values
+}
+
+func renderCiliumManifest(values []string) (string, error) {
+	tmpl, err := template.New("cilium").Parse(ciliumInstallManifest)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse cilium install manifest: %w", err)
+	}
+	var manifest bytes.Buffer
+	err = tmpl.Execute(&manifest, map[string]interface{}{
+		"Version":    ciliumVersion,
+		"CliVersion": ciliumCliVersion,
+		"Values":     values,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render cilium install manifest: %w", err)
+	}
+	return manifest.String(), nil
+}
@@ -0,0 +1,129 @@
+package cni
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"talos-azure/helpers"
+	"talos-azure/internal/testutil"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+func TestConfigPatch(t *testing.T) {
+	tests := []struct {
+		cni           string
+		wantPatch     bool
+		wantProxyOff  bool
+		wantManifests []string
+	}{
+		{"", false, false, nil},
+		{helpers.CniFlannel, false, false, nil},
+		{helpers.CniNone, true, false, nil},
+		{helpers.CniCilium, true, true, []string{"cilium-install"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cni, func(t *testing.T) {
+			values := testutil.RequiredConfig()
+			if tt.cni != "" {
+				values["cluster:cni"] = tt.cni
+			}
+			testutil.WithConfig(t, values, func(ctx *pulumi.Context) error {
+				patch, err := ConfigPatch(ctx)
+				if err != nil {
+					return err
+				}
+				if !tt.wantPatch {
+					if patch != nil {
+						t.Errorf("ConfigPatch() = %v, want no patch", patch)
+					}
+					return nil
+				}
+
+				var decoded struct {
+					Cluster struct {
+						Network struct {
+							Cni struct {
+								Name string `json:"name"`
+							} `json:"cni"`
+						} `json:"network"`
+						Proxy struct {
+							Disabled bool `json:"disabled"`
+						} `json:"proxy"`
+						InlineManifests []struct {
+							Name string `json:"name"`
+						} `json:"inlineManifests"`
+					} `json:"cluster"`
+				}
+				err = json.Unmarshal([]byte(patch.(pulumi.String)), &decoded)
+				if err != nil {
+					t.Fatalf("patch is not valid JSON: %v", err)
+				}
+				if decoded.Cluster.Network.Cni.Name != "none" {
+					t.Errorf("cni name = %q, want none", decoded.Cluster.Network.Cni.Name)
+				}
+				if decoded.Cluster.Proxy.Disabled != tt.wantProxyOff {
+					t.Errorf("proxy disabled = %v, want %v", decoded.Cluster.Proxy.Disabled, tt.wantProxyOff)
+				}
+				var manifests []string
+				for _, manifest := range decoded.Cluster.InlineManifests {
+					manifests = append(manifests, manifest.Name)
+				}
+				if !slices.Equal(manifests, tt.wantManifests) {
+					t.Errorf("inline manifests = %v, want %v", manifests, tt.wantManifests)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestCiliumValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		podCidrs []string
+		want     []string
+		dontWant []string
+	}{
+		{
+			"single-stack",
+			[]string{"10.244.0.0/16"},
+			[]string{"k8sServiceHost=localhost", "k8sServicePort=7445", "ipam.operator.clusterPoolIPv4PodCIDRList={10.244.0.0/16}"},
+			[]string{"ipv6.enabled=true"},
+		},
+		{
+			"dual-stack",
+			[]string{"10.244.0.0/16", "fd00:10:244::/56"},
+			[]string{"ipam.operator.clusterPoolIPv4PodCIDRList={10.244.0.0/16}", "ipv6.enabled=true", "ipam.operator.clusterPoolIPv6PodCIDRList={fd00:10:244::/56}"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := ciliumValues(helpers.CustomConfig{AddressSpace: helpers.AddressSpace{PodCidrs: tt.podCidrs}})
+			for _, value := range tt.want {
+				if !slices.Contains(values, value) {
+					t.Errorf("values %v don't contain %s", values, value)
+				}
+			}
+			for _, value := range tt.dontWant {
+				if slices.Contains(values, value) {
+					t.Errorf("values %v contain %s", values, value)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderCiliumManifest(t *testing.T) {
+	manifest, err := renderCiliumManifest([]string{"ipv6.enabled=true", "k8sServicePort=7445"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"quay.io/cilium/cilium-cli:" + ciliumCliVersion, "--version=" + ciliumVersion, "ipv6.enabled=true", "k8sServicePort=7445"} {
+		if !strings.Contains(manifest, want) {
+			t.Errorf("manifest doesn't contain %s", want)
+		}
+	}
+}
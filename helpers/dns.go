@@ -0,0 +1,66 @@
+package helpers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// DnsZoneRef points at an existing Azure DNS zone, parsed from its Azure resource ID
+type DnsZoneRef struct {
+	Id                string
+	ResourceGroupName string
+	ZoneName          string
+}
+
+// RecordName returns the name of the record set for fqdn relative to the zone, @ for the zone apex
+func (z DnsZoneRef) RecordName(fqdn string) string {
+	if strings.EqualFold(fqdn, z.ZoneName) {
+		return "@"
+	}
+	return strings.TrimSuffix(fqdn, "."+z.ZoneName)
+}
+
+// parseDnsZoneId parses IDs in the form
+// /subscriptions/<id>/resourceGroups/<rg>/providers/Microsoft.Network/dnszones/<zone>
+func parseDnsZoneId(id string) (DnsZoneRef, error) {
+	parts := strings.Split(strings.Trim(id, "/"), "/")
+	if len(parts) != 8 ||
+		!strings.EqualFold(parts[0], "subscriptions") ||
+		!strings.EqualFold(parts[2], "resourceGroups") ||
+		!strings.EqualFold(parts[4], "providers") ||
+		!strings.EqualFold(parts[5], "Microsoft.Network") ||
+		!strings.EqualFold(parts[6], "dnszones") {
+		return DnsZoneRef{}, fmt.Errorf("cluster:dnsZoneId %q is not a DNS zone resource ID", id)
+	}
+
+	return DnsZoneRef{
+		Id:                id,
+		ResourceGroupName: parts[3],
+		ZoneName:          strings.ToLower(parts[7]),
+	}, nil
+}
+
+// getEndpointDomain reads the optional FQDN of the cluster endpoint and the DNS zone its records are created in.
+// Without a zone the records have to be managed outside of the stack.
+func getEndpointDomain(clusterCfg *config.Config) (string, *DnsZoneRef, error) {
+	endpointDomain := strings.ToLower(strings.TrimSuffix(clusterCfg.Get("endpointDomain"), "."))
+	dnsZoneId := clusterCfg.Get("dnsZoneId")
+	if dnsZoneId == "" {
+		return endpointDomain, nil, nil
+	}
+	if endpointDomain == "" {
+		return "", nil, fmt.Errorf("cluster:endpointDomain has to be set when cluster:dnsZoneId is")
+	}
+
+	zone, err := parseDnsZoneId(dnsZoneId)
+	if err != nil {
+		return "", nil, err
+	}
+	if endpointDomain != zone.ZoneName && !strings.HasSuffix(endpointDomain, "."+zone.ZoneName) {
+		return "", nil, fmt.Errorf("cluster:endpointDomain %q is not within DNS zone %q", endpointDomain, zone.ZoneName)
+	}
+
+	return endpointDomain, &zone, nil
+}
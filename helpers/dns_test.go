@@ -0,0 +1,80 @@
+package helpers
+
+import (
+	"talos-azure/internal/testutil"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+func TestParseDnsZoneId(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		want    DnsZoneRef
+		wantErr string
+	}{
+		{
+			"zone",
+			"/subscriptions/sub/resourceGroups/dns/providers/Microsoft.Network/dnszones/Example.com",
+			DnsZoneRef{"/subscriptions/sub/resourceGroups/dns/providers/Microsoft.Network/dnszones/Example.com", "dns", "example.com"},
+			"",
+		},
+		{"private zone", "/subscriptions/sub/resourceGroups/dns/providers/Microsoft.Network/privateDnsZones/example.com", DnsZoneRef{}, "is not a DNS zone resource ID"},
+		{"record set", "/subscriptions/sub/resourceGroups/dns/providers/Microsoft.Network/dnszones/example.com/A/api", DnsZoneRef{}, "is not a DNS zone resource ID"},
+		{"name", "example.com", DnsZoneRef{}, "is not a DNS zone resource ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDnsZoneId(tt.id)
+			testutil.CheckErr(t, err, tt.wantErr)
+			if got != tt.want {
+				t.Errorf("parseDnsZoneId(%q) = %+v, want %+v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordName(t *testing.T) {
+	zone := DnsZoneRef{ZoneName: "example.com"}
+	tests := map[string]string{
+		"example.com":           "@",
+		"api.example.com":       "api",
+		"api.talos.example.com": "api.talos",
+	}
+	for fqdn, want := range tests {
+		if got := zone.RecordName(fqdn); got != want {
+			t.Errorf("RecordName(%q) = %q, want %q", fqdn, got, want)
+		}
+	}
+}
+
+func TestGetEndpointDomain(t *testing.T) {
+	zoneId := "/subscriptions/sub/resourceGroups/dns/providers/Microsoft.Network/dnszones/example.com"
+	tests := []struct {
+		name    string
+		values  map[string]string
+		want    string
+		wantErr string
+	}{
+		{"unset", map[string]string{}, "", ""},
+		{"without zone", map[string]string{"cluster:endpointDomain": "API.example.com."}, "api.example.com", ""},
+		{"within zone", map[string]string{"cluster:endpointDomain": "api.example.com", "cluster:dnsZoneId": zoneId}, "api.example.com", ""},
+		{"zone apex", map[string]string{"cluster:endpointDomain": "example.com", "cluster:dnsZoneId": zoneId}, "example.com", ""},
+		{"zone without domain", map[string]string{"cluster:dnsZoneId": zoneId}, "", "cluster:endpointDomain has to be set"},
+		{"outside zone", map[string]string{"cluster:endpointDomain": "api.notexample.com", "cluster:dnsZoneId": zoneId}, "", `is not within DNS zone "example.com"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testutil.WithConfig(t, tt.values, func(ctx *pulumi.Context) error {
+				got, _, err := getEndpointDomain(config.New(ctx, "cluster"))
+				testutil.CheckErr(t, err, tt.wantErr)
+				if got != tt.want {
+					t.Errorf("getEndpointDomain() = %q, want %q", got, tt.want)
+				}
+				return nil
+			})
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+const (
+	defaultGalleryName = "talos"
+	// imageCacheDir is the directory within the user cache directory disk images are kept in by default
+	imageCacheDir = "talos-azure"
+)
+
+var (
+	galleryNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._]*$`)
+	versionPattern     = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+)
+
+// ImageGallery uploads a Talos VHD into a Shared Image Gallery of the stack, which the VMs boot from
+// instead of the Sidero Labs community gallery
+type ImageGallery struct {
+	// Source is a local path or http(s) URL of a Talos azure-<arch>.vhd, optionally xz compressed.
+	// It defaults to the disk image of cluster:schematic when customImage is set.
+	Source      string `json:"source"`
+	GalleryName string `json:"galleryName"`
+	// Version is the gallery image version, the resolved cluster:talos-version by default. It is published with a hash
+	// of the VHD as patch field, so every VHD gets a version of its own.
+	Version string `json:"version"`
+	// ReplicationRegions are replicated to in addition to the region of the stack
+	ReplicationRegions []string `json:"replicationRegions"`
+}
+
+// ImageVersion returns the configured version, or the resolved Talos version when none is set
+func (g ImageGallery) ImageVersion(talosVersion string) string {
+	if g.Version != "" {
+		return g.Version
+	}
+	return strings.TrimPrefix(talosVersion, "v")
+}
+
+// defaultImageDir keeps disk images, which are several GB, out of the working directory. The temp directory is
+// used when the user has no cache directory.
+func defaultImageDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return filepath.Join(cacheDir, imageCacheDir, "images")
+}
+
+func getImageGallery(clusterCfg *config.Config, schematic *Schematic) (*ImageGallery, error) {
+	var gallery *ImageGallery
+	err := clusterCfg.GetObject("imageGallery", &gallery)
+	if err != nil {
+		return nil, fmt.Errorf("cluster:imageGallery config is invalid, %w", err)
+	}
+	if gallery == nil {
+		return nil, nil
+	}
+
+	customImage := schematic != nil && schematic.CustomImage
+	if gallery.Source == "" && !customImage {
+		return nil, fmt.Errorf("cluster:imageGallery requires a source unless cluster:schematic customImage is set")
+	}
+	if gallery.Source != "" && customImage {
+		return nil, fmt.Errorf("cluster:imageGallery source can't be combined with cluster:schematic customImage")
+	}
+	if gallery.GalleryName == "" {
+		gallery.GalleryName = defaultGalleryName
+	}
+	if !galleryNamePattern.MatchString(gallery.GalleryName) {
+		return nil, fmt.Errorf("cluster:imageGallery galleryName may only contain letters, digits, dots and underscores, got %q", gallery.GalleryName)
+	}
+	if gallery.Version != "" && !versionPattern.MatchString(gallery.Version) {
+		return nil, fmt.Errorf("cluster:imageGallery version must be in the form major.minor.patch, got %q", gallery.Version)
+	}
+	for i, region := range gallery.ReplicationRegions {
+		if region == "" {
+			return nil, fmt.Errorf("cluster:imageGallery replicationRegions[%d] is empty", i)
+		}
+	}
+
+	return gallery, nil
+}
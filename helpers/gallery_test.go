@@ -0,0 +1,25 @@
+package helpers
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDefaultImageDir(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the user cache directory is only configured through XDG_CACHE_HOME on Linux")
+	}
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+	if got, want := defaultImageDir(), filepath.Join(cacheDir, "talos-azure", "images"); got != want {
+		t.Errorf("defaultImageDir() = %s, want %s", got, want)
+	}
+
+	// Without a home directory there is no cache directory either
+	t.Setenv("XDG_CACHE_HOME", "")
+	t.Setenv("HOME", "")
+	if got := defaultImageDir(); !filepath.IsAbs(got) {
+		t.Errorf("defaultImageDir() = %s, want an absolute path within the temp directory", got)
+	}
+}
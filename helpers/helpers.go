@@ -2,21 +2,75 @@ package helpers
 
 import (
 	"fmt"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
 )
 
+const (
+	NetworkModePublic  = "public"
+	NetworkModePrivate = "private"
+
+	CniFlannel = "flannel"
+	CniCilium  = "cilium"
+	CniNone    = "none"
+)
+
 type CustomConfig struct {
 	AzRegion          string
-	WorkerCount       int
-	ControlCount      int
+	NodePools         []NodePool
+	ConfigPatches     ConfigPatches
 	Architecture      string
-	TalosVersion      string
 	ClusterName       string
-	Vm                string
 	ResourceGroupName string
+	WriteKubeconfig   bool
+	HealthTimeout     string
+	ArtifactsDir      string
+	// NetworkMode is either public or private, private clusters have no public node or load balancer IPs
+	NetworkMode        string
+	AllowedSources     AllowedSources
+	ExtraSecurityRules []SecurityRule
+	// RemoveInlineRules empties the rules defined inline on the network security group, which stacks deployed
+	// before the rules became separate resources still have
+	RemoveInlineRules bool
+	// ExistingSubnet is set when nodes are placed into an existing subnet instead of a VNet created by the stack
+	ExistingSubnet *SubnetRef
+	AddressSpace   AddressSpace
+	// Zones are the availability zones nodes are spread across, empty to use an availability set instead
+	Zones []string
+	// LoadBalanceApid adds a load balancer rule for the Talos API next to the Kubernetes API one
+	LoadBalanceApid bool
+	// EndpointDomain is the FQDN of the cluster endpoint, the load balancer IP is used when empty
+	EndpointDomain string
+	// DnsZone is set when the records of EndpointDomain are managed by the stack
+	DnsZone *DnsZoneRef
+	// CloudProvider installs the Azure cloud controller manager and the Azure Disk CSI driver
+	CloudProvider bool
+	// Cni is flannel (the Talos default), cilium or none to install a CNI manually
+	Cni string
+	// Schematic is set when the Talos image is customized through the Image Factory
+	Schematic *Schematic
+	// ImageGallery is set when VMs boot from a Shared Image Gallery of the stack
+	ImageGallery *ImageGallery
+	// ImageDir is where disk images are downloaded to and kept between runs
+	ImageDir string
+	Upgrade  Upgrade
+	// KubernetesVersion is set when the version isn't left to the Talos default, without the v prefix
+	KubernetesVersion string
+}
+
+func (c CustomConfig) IsPrivate() bool {
+	return c.NetworkMode == NetworkModePrivate
+}
+
+// NodeZone returns the availability zone of the i-th node of a pool, or an empty string when zones aren't used
+func (c CustomConfig) NodeZone(i int) string {
+	if len(c.Zones) == 0 {
+		return ""
+	}
+	return c.Zones[i%len(c.Zones)]
 }
 
 func GetConfig(ctx *pulumi.Context) (CustomConfig, error) {
@@ -28,6 +82,14 @@ func GetConfig(ctx *pulumi.Context) (CustomConfig, error) {
 	if azConf == nil {
 		return CustomConfig{}, getConfNotFoundErr("azure", "top level")
 	}
+	networkCfg := config.New(ctx, "network")
+	if networkCfg == nil {
+		return CustomConfig{}, getConfNotFoundErr("network", "top level")
+	}
+	azureCfg := config.New(ctx, "azure")
+	if azureCfg == nil {
+		return CustomConfig{}, getConfNotFoundErr("azure", "top level")
+	}
 
 	azRegion := azConf.Require("location")
 	if azRegion == "" {
@@ -38,21 +100,13 @@ func GetConfig(ctx *pulumi.Context) (CustomConfig, error) {
 		return CustomConfig{}, getConfNotFoundErr("azure", "resource-group-name")
 	}
 
-	workerCountS := clusterCfg.Require("workers")
-	if workerCountS == "" {
-		return CustomConfig{}, getConfNotFoundErr("azure", "workers")
-	}
-	workerCount, err := strconv.Atoi(workerCountS)
+	nodePools, err := getNodePools(clusterCfg)
 	if err != nil {
-		return CustomConfig{}, fmt.Errorf("cluster:workers config must be an integer, %e", err)
+		return CustomConfig{}, err
 	}
-	controlCountS := clusterCfg.Require("controls")
-	if controlCountS == "" {
-		return CustomConfig{}, getConfNotFoundErr("cluster", "controls")
-	}
-	controlCount, err := strconv.Atoi(controlCountS)
+	configPatches, err := getConfigPatches(clusterCfg, nodePools)
 	if err != nil {
-		return CustomConfig{}, fmt.Errorf("cluster:workers config must be an integer, %e", err)
+		return CustomConfig{}, err
 	}
 
 	arc := clusterCfg.Require("architecture")
@@ -60,9 +114,25 @@ func GetConfig(ctx *pulumi.Context) (CustomConfig, error) {
 		return CustomConfig{}, getConfNotFoundErr("cluster", "architecture")
 	}
 
-	talosVer := clusterCfg.Require("talos-version")
-	if talosVer == "" {
-		return CustomConfig{}, getConfNotFoundErr("cluster", "talos-version")
+	schematic, err := getSchematic(clusterCfg)
+	if err != nil {
+		return CustomConfig{}, err
+	}
+	imageGallery, err := getImageGallery(clusterCfg, schematic)
+	if err != nil {
+		return CustomConfig{}, err
+	}
+	upgrade, err := getUpgrade(clusterCfg)
+	if err != nil {
+		return CustomConfig{}, err
+	}
+	kubernetesVersion := strings.TrimPrefix(clusterCfg.Get("kubernetesVersion"), "v")
+	if kubernetesVersion != "" && !versionPattern.MatchString(kubernetesVersion) {
+		return CustomConfig{}, fmt.Errorf("cluster:kubernetesVersion must be in the form major.minor.patch, got %q", kubernetesVersion)
+	}
+	imageDir := clusterCfg.Get("imageDir")
+	if imageDir == "" {
+		imageDir = defaultImageDir()
 	}
 
 	name := clusterCfg.Require("name")
@@ -70,20 +140,108 @@ func GetConfig(ctx *pulumi.Context) (CustomConfig, error) {
 		return CustomConfig{}, getConfNotFoundErr("cluster", "name")
 	}
 
-	vm := clusterCfg.Require("vm")
-	if name == "" {
-		return CustomConfig{}, getConfNotFoundErr("cluster", "vm")
+	writeKubeconfig := clusterCfg.GetBool("write-kubeconfig")
+
+	cni := clusterCfg.Get("cni")
+	if cni == "" {
+		cni = CniFlannel
+	}
+	if cni != CniFlannel && cni != CniCilium && cni != CniNone {
+		return CustomConfig{}, fmt.Errorf("cluster:cni must be %q, %q or %q, got %q", CniFlannel, CniCilium, CniNone, cni)
+	}
+
+	var zones []string
+	err = clusterCfg.GetObject("zones", &zones)
+	if err != nil {
+		return CustomConfig{}, fmt.Errorf("cluster:zones config must be a list of zones, %w", err)
+	}
+	seenZones := map[string]bool{}
+	for _, zone := range zones {
+		if zone == "" || seenZones[zone] {
+			return CustomConfig{}, fmt.Errorf("cluster:zones must contain unique, non empty zones, got %v", zones)
+		}
+		seenZones[zone] = true
+	}
+
+	endpointDomain, dnsZone, err := getEndpointDomain(clusterCfg)
+	if err != nil {
+		return CustomConfig{}, err
+	}
+
+	networkMode := networkCfg.Get("mode")
+	if networkMode == "" {
+		networkMode = NetworkModePublic
+	}
+	if networkMode != NetworkModePublic && networkMode != NetworkModePrivate {
+		return CustomConfig{}, fmt.Errorf("network:mode must be %q or %q, got %q", NetworkModePublic, NetworkModePrivate, networkMode)
+	}
+
+	allowedSources, err := getAllowedSources(networkCfg, networkMode)
+	if err != nil {
+		return CustomConfig{}, err
+	}
+	extraSecurityRules, err := getExtraSecurityRules(networkCfg)
+	if err != nil {
+		return CustomConfig{}, err
+	}
+	removeInlineRules := networkCfg.GetBool("removeInlineRules")
+
+	var existingSubnet *SubnetRef
+	if existingSubnetId := networkCfg.Get("existingSubnetId"); existingSubnetId != "" {
+		ref, err := parseSubnetId(existingSubnetId)
+		if err != nil {
+			return CustomConfig{}, err
+		}
+		existingSubnet = &ref
+	}
+
+	addressSpace, err := getAddressSpace(networkCfg, len(zones))
+	if err != nil {
+		return CustomConfig{}, err
+	}
+	loadBalanceApid := networkCfg.GetBool("loadBalanceApid")
+	cloudProvider := azureCfg.GetBool("cloudProvider")
+
+	artifactsDir := clusterCfg.Get("artifacts-dir")
+	if artifactsDir == "" {
+		artifactsDir = "secrets"
+	}
+
+	healthTimeout := clusterCfg.Get("health-timeout")
+	if healthTimeout == "" {
+		healthTimeout = "10m"
+	}
+	if _, err := time.ParseDuration(healthTimeout); err != nil {
+		return CustomConfig{}, fmt.Errorf("cluster:health-timeout config must be a duration such as 10m, %w", err)
 	}
 
 	return CustomConfig{
-		AzRegion:          azRegion,
-		WorkerCount:       workerCount,
-		ControlCount:      controlCount,
-		Architecture:      arc,
-		TalosVersion:      talosVer,
-		ClusterName:       name,
-		Vm:                vm,
-		ResourceGroupName: resourceGroupName,
+		AzRegion:           azRegion,
+		NodePools:          nodePools,
+		ConfigPatches:      configPatches,
+		Architecture:       arc,
+		ClusterName:        name,
+		ResourceGroupName:  resourceGroupName,
+		WriteKubeconfig:    writeKubeconfig,
+		HealthTimeout:      healthTimeout,
+		ArtifactsDir:       artifactsDir,
+		NetworkMode:        networkMode,
+		AllowedSources:     allowedSources,
+		ExtraSecurityRules: extraSecurityRules,
+		RemoveInlineRules:  removeInlineRules,
+		ExistingSubnet:     existingSubnet,
+		AddressSpace:       addressSpace,
+		Zones:              zones,
+		LoadBalanceApid:    loadBalanceApid,
+		EndpointDomain:     endpointDomain,
+		DnsZone:            dnsZone,
+		CloudProvider:      cloudProvider,
+		Cni:                cni,
+		Schematic:          schematic,
+		ImageGallery:       imageGallery,
+		ImageDir:           imageDir,
+		Upgrade:            upgrade,
+		KubernetesVersion:  kubernetesVersion,
 	}, nil
 }
 
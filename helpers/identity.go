@@ -0,0 +1,88 @@
+package helpers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	IdentityTypeSystemAssigned = "SystemAssigned"
+	IdentityTypeUserAssigned   = "UserAssigned"
+
+	// ScopeResourceGroup refers to the resource group of the stack within role assignments
+	ScopeResourceGroup = "resourceGroup"
+)
+
+var guidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// NodeIdentity is the managed identity of the nodes of a pool. System assigned identities are created per VM,
+// or once for a scale set, user assigned ones are shared by all nodes of the pool.
+type NodeIdentity struct {
+	// Type is SystemAssigned or UserAssigned
+	Type            string           `json:"type"`
+	RoleAssignments []RoleAssignment `json:"roleAssignments"`
+}
+
+// RoleAssignment grants the identity a role on a resource group or resource
+type RoleAssignment struct {
+	// Scope is a resource group or resource ID within the subscription of the stack, or resourceGroup
+	Scope string `json:"scope"`
+	// Role is a role definition GUID or ID, e.g. befefa01-2a29-4197-83a8-272ff33ce314 for DNS Zone Contributor
+	Role string `json:"role"`
+	// RoleId and ScopeId are derived from Role and Scope, ScopeId is empty for the resource group of the stack
+	RoleId  string `json:"-"`
+	ScopeId string `json:"-"`
+}
+
+// parseRoleScope parses resourceGroup or IDs in the form /subscriptions/<id>/resourceGroups/<rg>
+// and /subscriptions/<id>/resourceGroups/<rg>/providers/<namespace>/<type>/<name>[/<type>/<name>...]
+func parseRoleScope(scope string) (string, error) {
+	if scope == ScopeResourceGroup {
+		return "", nil
+	}
+
+	parts := strings.Split(strings.Trim(scope, "/"), "/")
+	if len(parts) < 4 ||
+		!strings.EqualFold(parts[0], "subscriptions") ||
+		!strings.EqualFold(parts[2], "resourceGroups") {
+		return "", fmt.Errorf("scope %q is neither %s nor a resource group or resource ID", scope, ScopeResourceGroup)
+	}
+	if len(parts) > 4 && (len(parts) < 8 || len(parts)%2 != 0 || !strings.EqualFold(parts[4], "providers")) {
+		return "", fmt.Errorf("scope %q is neither %s nor a resource group or resource ID", scope, ScopeResourceGroup)
+	}
+	return "/" + strings.Join(parts, "/"), nil
+}
+
+// parseRoleId accepts a role definition GUID or ID and returns the GUID
+func parseRoleId(role string) (string, error) {
+	roleId := role[strings.LastIndex(role, "/")+1:]
+	if !guidPattern.MatchString(roleId) {
+		return "", fmt.Errorf("role %q is neither a role definition GUID nor ID", role)
+	}
+	return strings.ToLower(roleId), nil
+}
+
+func setIdentityDefaults(name string, identity *NodeIdentity) error {
+	if identity.Type == "" {
+		identity.Type = IdentityTypeUserAssigned
+	}
+	if identity.Type != IdentityTypeSystemAssigned && identity.Type != IdentityTypeUserAssigned {
+		return fmt.Errorf("%s type must be %q or %q, got %q", name, IdentityTypeSystemAssigned, IdentityTypeUserAssigned, identity.Type)
+	}
+
+	for i := range identity.RoleAssignments {
+		assignment := &identity.RoleAssignments[i]
+		var err error
+		assignment.ScopeId, err = parseRoleScope(assignment.Scope)
+		if err != nil {
+			return fmt.Errorf("%s roleAssignments[%d] %w", name, i, err)
+		}
+		assignment.RoleId, err = parseRoleId(assignment.Role)
+		if err != nil {
+			return fmt.Errorf("%s roleAssignments[%d] %w", name, i, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package helpers
+
+import (
+	"talos-azure/internal/testutil"
+	"testing"
+)
+
+func TestParseRoleScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		scope   string
+		want    string
+		wantErr string
+	}{
+		{"stack resource group", "resourceGroup", "", ""},
+		{"resource group", "/subscriptions/sub/resourceGroups/dns/", "/subscriptions/sub/resourceGroups/dns", ""},
+		{"resource", "/subscriptions/sub/resourceGroups/dns/providers/Microsoft.Network/dnszones/example.com", "/subscriptions/sub/resourceGroups/dns/providers/Microsoft.Network/dnszones/example.com", ""},
+		{"child resource", "subscriptions/sub/resourceGroups/net/providers/Microsoft.Network/virtualNetworks/vnet/subnets/nodes", "/subscriptions/sub/resourceGroups/net/providers/Microsoft.Network/virtualNetworks/vnet/subnets/nodes", ""},
+		{"subscription", "/subscriptions/sub", "", "is neither resourceGroup nor a resource group or resource ID"},
+		{"resource group name", "dns", "", "is neither resourceGroup nor a resource group or resource ID"},
+		{"incomplete resource", "/subscriptions/sub/resourceGroups/dns/providers/Microsoft.Network/dnszones", "", "is neither resourceGroup nor a resource group or resource ID"},
+		{"no providers", "/subscriptions/sub/resourceGroups/dns/other/Microsoft.Network/dnszones/example.com", "", "is neither resourceGroup nor a resource group or resource ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRoleScope(tt.scope)
+			testutil.CheckErr(t, err, tt.wantErr)
+			if got != tt.want {
+				t.Errorf("parseRoleScope(%q) = %q, want %q", tt.scope, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRoleId(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    string
+		want    string
+		wantErr string
+	}{
+		{"guid", "befefa01-2a29-4197-83a8-272ff33ce314", "befefa01-2a29-4197-83a8-272ff33ce314", ""},
+		{"upper case guid", "BEFEFA01-2A29-4197-83A8-272FF33CE314", "befefa01-2a29-4197-83a8-272ff33ce314", ""},
+		{"definition id", "/subscriptions/sub/providers/Microsoft.Authorization/roleDefinitions/befefa01-2a29-4197-83a8-272ff33ce314", "befefa01-2a29-4197-83a8-272ff33ce314", ""},
+		{"role name", "DNS Zone Contributor", "", "is neither a role definition GUID nor ID"},
+		{"empty", "", "", "is neither a role definition GUID nor ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRoleId(tt.role)
+			testutil.CheckErr(t, err, tt.wantErr)
+			if got != tt.want {
+				t.Errorf("parseRoleId(%q) = %q, want %q", tt.role, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package helpers
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// SubnetRef points at an existing subnet, parsed from its Azure resource ID
+type SubnetRef struct {
+	Id string
+	// SubscriptionId has to be the subscription the stack deploys to
+	SubscriptionId     string
+	ResourceGroupName  string
+	VirtualNetworkName string
+	SubnetName         string
+}
+
+// parseSubnetId parses IDs in the form
+// /subscriptions/<id>/resourceGroups/<rg>/providers/Microsoft.Network/virtualNetworks/<vnet>/subnets/<subnet>
+func parseSubnetId(id string) (SubnetRef, error) {
+	parts := strings.Split(strings.Trim(id, "/"), "/")
+	if len(parts) != 10 ||
+		!strings.EqualFold(parts[0], "subscriptions") ||
+		!strings.EqualFold(parts[2], "resourceGroups") ||
+		!strings.EqualFold(parts[4], "providers") ||
+		!strings.EqualFold(parts[5], "Microsoft.Network") ||
+		!strings.EqualFold(parts[6], "virtualNetworks") ||
+		!strings.EqualFold(parts[8], "subnets") {
+		return SubnetRef{}, fmt.Errorf("network:existingSubnetId %q is not a subnet resource ID", id)
+	}
+
+	return SubnetRef{
+		Id:                 id,
+		SubscriptionId:     parts[1],
+		ResourceGroupName:  parts[3],
+		VirtualNetworkName: parts[7],
+		SubnetName:         parts[9],
+	}, nil
+}
+
+const (
+	IPFamilyV4 = "IPv4"
+	IPFamilyV6 = "IPv6"
+)
+
+// AddressSpace holds the Azure and Kubernetes address ranges of the cluster
+type AddressSpace struct {
+	VnetCidr string
+	// ControlplaneSubnets and WorkerSubnets hold one subnet per availability zone, or a single one without zones
+	ControlplaneSubnets []string
+	WorkerSubnets       []string
+	// DualStack adds the IPv6 ranges below to the IPv4 ones, Azure doesn't support IPv6 only networks
+	DualStack             bool
+	VnetCidrV6            string
+	ControlplaneSubnetsV6 []string
+	WorkerSubnetsV6       []string
+	// PodCidrs and ServiceCidrs contain one CIDR per IP family
+	PodCidrs     []string
+	ServiceCidrs []string
+}
+
+// RoleSubnets returns the IPv4 subnets of the given node role
+func (a AddressSpace) RoleSubnets(role string) []string {
+	if role == RoleControlplane {
+		return a.ControlplaneSubnets
+	}
+	return a.WorkerSubnets
+}
+
+// RoleSubnetsV6 returns the IPv6 subnets of the given node role, empty unless the cluster is dual-stack
+func (a AddressSpace) RoleSubnetsV6(role string) []string {
+	if role == RoleControlplane {
+		return a.ControlplaneSubnetsV6
+	}
+	return a.WorkerSubnetsV6
+}
+
+// NodeSubnets returns the subnets of all roles and IP families
+func (a AddressSpace) NodeSubnets() []string {
+	subnets := make([]string, 0)
+	for _, cidrs := range [][]string{a.ControlplaneSubnets, a.WorkerSubnets, a.ControlplaneSubnetsV6, a.WorkerSubnetsV6} {
+		subnets = append(subnets, cidrs...)
+	}
+	return subnets
+}
+
+func getAddressSpace(networkCfg *config.Config, zoneCount int) (AddressSpace, error) {
+	if zoneCount == 0 {
+		zoneCount = 1
+	}
+
+	var ipFamilies []string
+	err := networkCfg.GetObject("ipFamilies", &ipFamilies)
+	if err != nil {
+		return AddressSpace{}, fmt.Errorf("network:ipFamilies config must be a list of IP families, %w", err)
+	}
+	space := AddressSpace{}
+	switch {
+	case len(ipFamilies) == 0 || (len(ipFamilies) == 1 && ipFamilies[0] == IPFamilyV4):
+	case len(ipFamilies) == 2 && ipFamilies[0] != ipFamilies[1] &&
+		(ipFamilies[0] == IPFamilyV4 || ipFamilies[0] == IPFamilyV6) &&
+		(ipFamilies[1] == IPFamilyV4 || ipFamilies[1] == IPFamilyV6):
+		space.DualStack = true
+	default:
+		return AddressSpace{}, fmt.Errorf("network:ipFamilies must be [%s] or [%s, %s], got %v", IPFamilyV4, IPFamilyV4, IPFamilyV6, ipFamilies)
+	}
+
+	space.VnetCidr = networkCfg.Get("vnetCidr")
+	if space.VnetCidr == "" {
+		space.VnetCidr = "10.0.0.0/16"
+	}
+	space.VnetCidrV6 = networkCfg.Get("vnetCidrV6")
+	if space.DualStack && space.VnetCidrV6 == "" {
+		space.VnetCidrV6 = "fd00:10::/48"
+	}
+	for _, key := range []struct {
+		name   string
+		target *[]string
+	}{
+		{"controlplaneSubnetCidrs", &space.ControlplaneSubnets},
+		{"workerSubnetCidrs", &space.WorkerSubnets},
+		{"controlplaneSubnetCidrsV6", &space.ControlplaneSubnetsV6},
+		{"workerSubnetCidrsV6", &space.WorkerSubnetsV6},
+		{"podCidrs", &space.PodCidrs},
+		{"serviceCidrs", &space.ServiceCidrs},
+	} {
+		err := networkCfg.GetObject(key.name, key.target)
+		if err != nil {
+			return AddressSpace{}, fmt.Errorf("network:%s config must be a list of CIDRs, %w", key.name, err)
+		}
+	}
+	if !space.DualStack && (space.VnetCidrV6 != "" || len(space.ControlplaneSubnetsV6) > 0 || len(space.WorkerSubnetsV6) > 0) {
+		return AddressSpace{}, fmt.Errorf("IPv6 address spaces require network:ipFamilies to contain %s", IPFamilyV6)
+	}
+
+	// By default control plane subnets are 10.0.<zone index>.0/24 and worker subnets 10.0.<16 * (zone index + 1)>.0/20,
+	// the IPv6 ones follow the same pattern within fd00:10::/48.
+	if len(space.ControlplaneSubnets) == 0 || len(space.WorkerSubnets) == 0 {
+		if space.VnetCidr != "10.0.0.0/16" {
+			return AddressSpace{}, fmt.Errorf("network:controlplaneSubnetCidrs and network:workerSubnetCidrs have to be set when network:vnetCidr is")
+		}
+		for i := 0; i < zoneCount; i++ {
+			if len(space.ControlplaneSubnets) < zoneCount {
+				space.ControlplaneSubnets = append(space.ControlplaneSubnets, fmt.Sprintf("10.0.%d.0/24", i))
+			}
+			if len(space.WorkerSubnets) < zoneCount {
+				space.WorkerSubnets = append(space.WorkerSubnets, fmt.Sprintf("10.0.%d.0/20", 16*(i+1)))
+			}
+		}
+	}
+	if space.DualStack && (len(space.ControlplaneSubnetsV6) == 0 || len(space.WorkerSubnetsV6) == 0) {
+		if space.VnetCidrV6 != "fd00:10::/48" {
+			return AddressSpace{}, fmt.Errorf("network:controlplaneSubnetCidrsV6 and network:workerSubnetCidrsV6 have to be set when network:vnetCidrV6 is")
+		}
+		for i := 0; i < zoneCount; i++ {
+			if len(space.ControlplaneSubnetsV6) < zoneCount {
+				space.ControlplaneSubnetsV6 = append(space.ControlplaneSubnetsV6, fmt.Sprintf("fd00:10:0:%x::/64", i))
+			}
+			if len(space.WorkerSubnetsV6) < zoneCount {
+				space.WorkerSubnetsV6 = append(space.WorkerSubnetsV6, fmt.Sprintf("fd00:10:0:%x::/64", 16*(i+1)))
+			}
+		}
+	}
+
+	if len(space.PodCidrs) == 0 {
+		space.PodCidrs = []string{"10.244.0.0/16"}
+		if space.DualStack {
+			space.PodCidrs = append(space.PodCidrs, "fd00:10:244::/56")
+		}
+	}
+	if len(space.ServiceCidrs) == 0 {
+		space.ServiceCidrs = []string{"10.96.0.0/12"}
+		if space.DualStack {
+			space.ServiceCidrs = append(space.ServiceCidrs, "fd00:10:96::/112")
+		}
+	}
+
+	return space, validateAddressSpace(space, zoneCount)
+}
+
+func validateAddressSpace(space AddressSpace, zoneCount int) error {
+	subnetCounts := []int{len(space.ControlplaneSubnets), len(space.WorkerSubnets)}
+	if space.DualStack {
+		subnetCounts = append(subnetCounts, len(space.ControlplaneSubnetsV6), len(space.WorkerSubnetsV6))
+	}
+	for _, count := range subnetCounts {
+		if count != zoneCount {
+			return fmt.Errorf("network control plane and worker subnet CIDRs must contain one CIDR per zone")
+		}
+	}
+
+	vnets := make([]netip.Prefix, 0)
+	for _, vnetCidr := range []string{space.VnetCidr, space.VnetCidrV6} {
+		if vnetCidr == "" {
+			continue
+		}
+		vnet, err := netip.ParsePrefix(vnetCidr)
+		if err != nil {
+			return fmt.Errorf("network VNet CIDR %s is invalid, %w", vnetCidr, err)
+		}
+		vnets = append(vnets, vnet)
+	}
+
+	// Subnets have to be within the VNet, while pod and service CIDRs must not overlap with anything
+	prefixes := make([]namedPrefix, 0)
+	for _, cidrs := range []struct {
+		name       string
+		cidrs      []string
+		nodeSubnet bool
+	}{
+		{"network:controlplaneSubnetCidrs", space.ControlplaneSubnets, true},
+		{"network:workerSubnetCidrs", space.WorkerSubnets, true},
+		{"network:controlplaneSubnetCidrsV6", space.ControlplaneSubnetsV6, true},
+		{"network:workerSubnetCidrsV6", space.WorkerSubnetsV6, true},
+		{"network:podCidrs", space.PodCidrs, false},
+		{"network:serviceCidrs", space.ServiceCidrs, false},
+	} {
+		families := map[bool]bool{}
+		for _, cidr := range cidrs.cidrs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return fmt.Errorf("%s contains an invalid CIDR, %w", cidrs.name, err)
+			}
+			if prefix.Masked() != prefix {
+				return fmt.Errorf("%s CIDR %s has host bits set, did you mean %s", cidrs.name, cidr, prefix.Masked())
+			}
+			if cidrs.nodeSubnet && strings.HasSuffix(cidrs.name, "V6") == prefix.Addr().Is4() {
+				return fmt.Errorf("%s CIDR %s is of the wrong IP family", cidrs.name, cidr)
+			}
+			families[prefix.Addr().Is4()] = true
+			prefixes = append(prefixes, namedPrefix{cidrs.name, prefix, cidrs.nodeSubnet})
+		}
+		if !cidrs.nodeSubnet && (!families[true] || (space.DualStack != families[false])) {
+			return fmt.Errorf("%s must contain one IPv4 CIDR, and one IPv6 CIDR for dual-stack clusters", cidrs.name)
+		}
+	}
+
+	for i, prefix := range prefixes {
+		for _, vnet := range vnets {
+			if prefix.nodeSubnet && vnet.Addr().Is4() == prefix.prefix.Addr().Is4() && !containsPrefix(vnet, prefix.prefix) {
+				return fmt.Errorf("%s CIDR %s is not within the VNet CIDR %s", prefix.name, prefix.prefix, vnet)
+			}
+			if !prefix.nodeSubnet && vnet.Overlaps(prefix.prefix) {
+				return fmt.Errorf("%s CIDR %s overlaps with the VNet CIDR %s", prefix.name, prefix.prefix, vnet)
+			}
+		}
+		for _, other := range prefixes[i+1:] {
+			if prefix.prefix.Overlaps(other.prefix) {
+				return fmt.Errorf("%s CIDR %s overlaps with %s CIDR %s", prefix.name, prefix.prefix, other.name, other.prefix)
+			}
+		}
+	}
+
+	return nil
+}
+
+type namedPrefix struct {
+	name       string
+	prefix     netip.Prefix
+	nodeSubnet bool
+}
+
+func containsPrefix(outer netip.Prefix, inner netip.Prefix) bool {
+	return outer.Bits() <= inner.Bits() && outer.Contains(inner.Addr())
+}
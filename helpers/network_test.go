@@ -0,0 +1,97 @@
+package helpers
+
+import (
+	"talos-azure/internal/testutil"
+	"testing"
+)
+
+func TestParseSubnetId(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		want    SubnetRef
+		wantErr string
+	}{
+		{
+			"subnet",
+			"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/nodes",
+			SubnetRef{"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/nodes", "sub", "rg", "vnet", "nodes"},
+			"",
+		},
+		{
+			"case insensitive",
+			"/SUBSCRIPTIONS/sub/resourcegroups/rg/providers/microsoft.network/virtualnetworks/vnet/Subnets/nodes/",
+			SubnetRef{"/SUBSCRIPTIONS/sub/resourcegroups/rg/providers/microsoft.network/virtualnetworks/vnet/Subnets/nodes/", "sub", "rg", "vnet", "nodes"},
+			"",
+		},
+		{"vnet", "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet", SubnetRef{}, "is not a subnet resource ID"},
+		{"other provider", "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualNetworks/vnet/subnets/nodes", SubnetRef{}, "is not a subnet resource ID"},
+		{"name", "nodes", SubnetRef{}, "is not a subnet resource ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSubnetId(tt.id)
+			testutil.CheckErr(t, err, tt.wantErr)
+			if got != tt.want {
+				t.Errorf("parseSubnetId(%q) = %+v, want %+v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAddressSpace(t *testing.T) {
+	valid := AddressSpace{
+		VnetCidr:            "10.0.0.0/16",
+		ControlplaneSubnets: []string{"10.0.0.0/24"},
+		WorkerSubnets:       []string{"10.0.1.0/24"},
+		PodCidrs:            []string{"10.244.0.0/16"},
+		ServiceCidrs:        []string{"10.96.0.0/12"},
+	}
+	dualStack := valid
+	dualStack.DualStack = true
+	dualStack.VnetCidrV6 = "fd00:10::/48"
+	dualStack.ControlplaneSubnetsV6 = []string{"fd00:10::/64"}
+	dualStack.WorkerSubnetsV6 = []string{"fd00:10:0:1::/64"}
+	dualStack.PodCidrs = []string{"10.244.0.0/16", "fd00:10:244::/56"}
+	dualStack.ServiceCidrs = []string{"10.96.0.0/12", "fd00:10:96::/112"}
+
+	tests := []struct {
+		name      string
+		modify    func(space *AddressSpace)
+		dualStack bool
+		zoneCount int
+		wantErr   string
+	}{
+		{"valid", func(space *AddressSpace) {}, false, 1, ""},
+		{"valid dual-stack", func(space *AddressSpace) {}, true, 1, ""},
+		{"zones", func(space *AddressSpace) {
+			space.ControlplaneSubnets = []string{"10.0.0.0/24", "10.0.2.0/24"}
+			space.WorkerSubnets = []string{"10.0.1.0/24", "10.0.3.0/24"}
+		}, false, 2, ""},
+		{"subnet per zone", func(space *AddressSpace) {}, false, 2, "must contain one CIDR per zone"},
+		{"invalid VNet", func(space *AddressSpace) { space.VnetCidr = "10.0.0.0" }, false, 1, "network VNet CIDR 10.0.0.0 is invalid"},
+		{"invalid CIDR", func(space *AddressSpace) { space.WorkerSubnets = []string{"10.0.1.0/33"} }, false, 1, "network:workerSubnetCidrs contains an invalid CIDR"},
+		{"host bits", func(space *AddressSpace) { space.WorkerSubnets = []string{"10.0.1.1/24"} }, false, 1, "did you mean 10.0.1.0/24"},
+		{"subnet outside VNet", func(space *AddressSpace) { space.WorkerSubnets = []string{"10.1.0.0/24"} }, false, 1, "is not within the VNet CIDR 10.0.0.0/16"},
+		{"subnet larger than VNet", func(space *AddressSpace) { space.ControlplaneSubnets = []string{"10.0.0.0/15"} }, false, 1, "is not within the VNet CIDR"},
+		{"subnets overlap", func(space *AddressSpace) { space.WorkerSubnets = []string{"10.0.0.128/25"} }, false, 1, "network:controlplaneSubnetCidrs CIDR 10.0.0.0/24 overlaps with network:workerSubnetCidrs CIDR 10.0.0.128/25"},
+		{"pods overlap VNet", func(space *AddressSpace) { space.PodCidrs = []string{"10.0.128.0/17"} }, false, 1, "network:podCidrs CIDR 10.0.128.0/17 overlaps with the VNet CIDR 10.0.0.0/16"},
+		{"pods overlap services", func(space *AddressSpace) { space.PodCidrs = []string{"10.96.0.0/16"} }, false, 1, "network:podCidrs CIDR 10.96.0.0/16 overlaps with network:serviceCidrs CIDR 10.96.0.0/12"},
+		{"no IPv4 pod CIDR", func(space *AddressSpace) { space.PodCidrs = []string{"fd00:10:244::/56"} }, false, 1, "network:podCidrs must contain one IPv4 CIDR"},
+		{"IPv6 pod CIDR without dual-stack", func(space *AddressSpace) { space.PodCidrs = []string{"10.244.0.0/16", "fd00:10:244::/56"} }, false, 1, "network:podCidrs must contain one IPv4 CIDR"},
+		{"missing IPv6 service CIDR", func(space *AddressSpace) { space.ServiceCidrs = []string{"10.96.0.0/12"} }, true, 1, "network:serviceCidrs must contain one IPv4 CIDR, and one IPv6 CIDR"},
+		{"IPv4 subnet as IPv6", func(space *AddressSpace) { space.WorkerSubnetsV6 = []string{"10.0.2.0/24"} }, true, 1, "network:workerSubnetCidrsV6 CIDR 10.0.2.0/24 is of the wrong IP family"},
+		{"IPv6 subnet outside VNet", func(space *AddressSpace) { space.WorkerSubnetsV6 = []string{"fd00:11::/64"} }, true, 1, "is not within the VNet CIDR fd00:10::/48"},
+		{"IPv6 pods overlap VNet", func(space *AddressSpace) { space.PodCidrs = []string{"10.244.0.0/16", "fd00:10:0:100::/56"} }, true, 1, "overlaps with the VNet CIDR fd00:10::/48"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			space := valid
+			if tt.dualStack {
+				space = dualStack
+			}
+			tt.modify(&space)
+			testutil.CheckErr(t, validateAddressSpace(space, tt.zoneCount), tt.wantErr)
+		})
+	}
+}
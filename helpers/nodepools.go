@@ -0,0 +1,198 @@
+package helpers
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+const (
+	RoleControlplane = "controlplane"
+	RoleWorker       = "worker"
+
+	defaultOsDiskSizeGB = 10
+
+	EvictionPolicyDeallocate = "Deallocate"
+	EvictionPolicyDelete     = "Delete"
+
+	// SpotLabel is set as label and NoSchedule taint on every node of a spot pool
+	SpotLabel = "node.kubernetes.io/lifecycle"
+)
+
+// NodePool describes a group of identical nodes sharing a role and VM size.
+type NodePool struct {
+	Name         string            `json:"name"`
+	Role         string            `json:"role"`
+	Count        int               `json:"count"`
+	VmSize       string            `json:"vmSize"`
+	OsDiskSizeGB int               `json:"osDiskSizeGB"`
+	Labels       map[string]string `json:"labels"`
+	// Taints follow the Talos machine.nodeTaints format, e.g. "dedicated": "db:NoSchedule"
+	Taints map[string]string `json:"taints"`
+	// ConfigPatches are applied to every node of the pool, see ConfigPatches for the format
+	ConfigPatches []string `json:"configPatches"`
+	// ScaleSet backs a worker pool with a Flexible virtual machine scale set instead of individual VMs
+	ScaleSet bool `json:"scaleSet"`
+	// Spot runs the nodes of a worker pool as Azure Spot VMs
+	Spot bool `json:"spot"`
+	// MaxPrice is the maximum price per hour in US dollars, -1 to pay up to the on-demand price
+	MaxPrice *float64 `json:"maxPrice"`
+	// EvictionPolicy is either Deallocate or Delete
+	EvictionPolicy string `json:"evictionPolicy"`
+	// Identity is the optional managed identity of the nodes
+	Identity *NodeIdentity `json:"identity"`
+	// legacy is set for the pools derived from cluster:controls and cluster:workers
+	legacy bool
+}
+
+func (p NodePool) IsControlplane() bool {
+	return p.Role == RoleControlplane
+}
+
+// NodeName returns the name of the i-th node in the pool, used for both the VM and its computer name.
+func (p NodePool) NodeName(i int) string {
+	return fmt.Sprintf("%s-%d", p.Name, i)
+}
+
+// NetworkPrefix is the name prefix of the NICs and public IPs of the pool. The control plane pool of the flat
+// cluster:controls config keeps the names its resources had before node pools existed, so they aren't replaced.
+func (p NodePool) NetworkPrefix() string {
+	if p.legacy && p.IsControlplane() {
+		return RoleControlplane
+	}
+	return p.Name
+}
+
+// getNodePools reads cluster:nodePools and falls back to the flat cluster:controls,
+// cluster:workers and cluster:vm settings when no pools are configured.
+func getNodePools(clusterCfg *config.Config) ([]NodePool, error) {
+	var pools []NodePool
+	err := clusterCfg.GetObject("nodePools", &pools)
+	if err != nil {
+		return nil, fmt.Errorf("cluster:nodePools config is invalid, %w", err)
+	}
+	if len(pools) == 0 {
+		pools, err = getLegacyNodePools(clusterCfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range pools {
+		if pools[i].OsDiskSizeGB == 0 {
+			pools[i].OsDiskSizeGB = defaultOsDiskSizeGB
+		}
+		if pools[i].Spot {
+			setSpotDefaults(&pools[i])
+		}
+		if pools[i].Identity != nil {
+			err = setIdentityDefaults(fmt.Sprintf("cluster:nodePools[%d].identity", i), pools[i].Identity)
+			if err != nil {
+				return nil, err
+			}
+		}
+		pools[i].ConfigPatches, err = loadPatches(fmt.Sprintf("cluster:nodePools[%d].configPatches", i), pools[i].ConfigPatches)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pools, validateNodePools(pools)
+}
+
+func getLegacyNodePools(clusterCfg *config.Config) ([]NodePool, error) {
+	workerCountS := clusterCfg.Get("workers")
+	if workerCountS == "" {
+		return nil, getConfNotFoundErr("cluster", "workers")
+	}
+	workerCount, err := strconv.Atoi(workerCountS)
+	if err != nil {
+		return nil, fmt.Errorf("cluster:workers config must be an integer, %w", err)
+	}
+	controlCountS := clusterCfg.Get("controls")
+	if controlCountS == "" {
+		return nil, getConfNotFoundErr("cluster", "controls")
+	}
+	controlCount, err := strconv.Atoi(controlCountS)
+	if err != nil {
+		return nil, fmt.Errorf("cluster:controls config must be an integer, %w", err)
+	}
+	vm := clusterCfg.Get("vm")
+	if vm == "" {
+		return nil, getConfNotFoundErr("cluster", "vm")
+	}
+
+	return []NodePool{
+		{Name: "control", Role: RoleControlplane, Count: controlCount, VmSize: vm, legacy: true},
+		{Name: "worker", Role: RoleWorker, Count: workerCount, VmSize: vm, legacy: true},
+	}, nil
+}
+
+func validateNodePools(pools []NodePool) error {
+	names := map[string]bool{}
+	controlCount := 0
+	for i, p := range pools {
+		if p.Name == "" {
+			return fmt.Errorf("cluster:nodePools[%d] has no name", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("cluster:nodePools name %q is used more than once", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.Role != RoleControlplane && p.Role != RoleWorker {
+			return fmt.Errorf("cluster:nodePools %q role must be %q or %q, got %q", p.Name, RoleControlplane, RoleWorker, p.Role)
+		}
+		if p.Count < 0 {
+			return fmt.Errorf("cluster:nodePools %q count must not be negative", p.Name)
+		}
+		if p.VmSize == "" {
+			return fmt.Errorf("cluster:nodePools %q has no vmSize", p.Name)
+		}
+		if p.ScaleSet && p.IsControlplane() {
+			return fmt.Errorf("cluster:nodePools %q can't be a scale set, only %s pools can", p.Name, RoleWorker)
+		}
+		if p.Spot && p.IsControlplane() {
+			return fmt.Errorf("cluster:nodePools %q can't use spot instances, only %s pools can", p.Name, RoleWorker)
+		}
+		if p.Spot && p.EvictionPolicy != EvictionPolicyDeallocate && p.EvictionPolicy != EvictionPolicyDelete {
+			return fmt.Errorf("cluster:nodePools %q evictionPolicy must be %q or %q, got %q", p.Name, EvictionPolicyDeallocate, EvictionPolicyDelete, p.EvictionPolicy)
+		}
+		if p.Spot && *p.MaxPrice != -1 && *p.MaxPrice <= 0 {
+			return fmt.Errorf("cluster:nodePools %q maxPrice must be -1 or greater than 0", p.Name)
+		}
+		if p.IsControlplane() {
+			controlCount += p.Count
+		}
+	}
+	if controlCount == 0 {
+		return fmt.Errorf("cluster:nodePools must contain at least one %s node", RoleControlplane)
+	}
+
+	return nil
+}
+
+// setSpotDefaults fills in the eviction settings and marks the nodes of a spot pool with a label and
+// taint, so only workloads that explicitly tolerate evictions are scheduled onto them.
+func setSpotDefaults(pool *NodePool) {
+	if pool.EvictionPolicy == "" {
+		pool.EvictionPolicy = EvictionPolicyDeallocate
+	}
+	if pool.MaxPrice == nil {
+		maxPrice := -1.0
+		pool.MaxPrice = &maxPrice
+	}
+	if pool.Labels == nil {
+		pool.Labels = map[string]string{}
+	}
+	if _, ok := pool.Labels[SpotLabel]; !ok {
+		pool.Labels[SpotLabel] = "spot"
+	}
+	if pool.Taints == nil {
+		pool.Taints = map[string]string{}
+	}
+	if _, ok := pool.Taints[SpotLabel]; !ok {
+		pool.Taints[SpotLabel] = "spot:NoSchedule"
+	}
+}
@@ -0,0 +1,63 @@
+package helpers
+
+import (
+	"talos-azure/internal/testutil"
+	"testing"
+)
+
+func TestValidateNodePools(t *testing.T) {
+	maxPrice := -1.0
+	invalidPrice := 0.0
+	control := NodePool{Name: "control", Role: RoleControlplane, Count: 3, VmSize: "Standard_B2s"}
+	worker := NodePool{Name: "worker", Role: RoleWorker, Count: 2, VmSize: "Standard_B2s"}
+	spot := NodePool{Name: "spot", Role: RoleWorker, Count: 2, VmSize: "Standard_B2s", Spot: true, EvictionPolicy: EvictionPolicyDelete, MaxPrice: &maxPrice}
+
+	withChanges := func(pool NodePool, change func(*NodePool)) NodePool {
+		change(&pool)
+		return pool
+	}
+
+	tests := []struct {
+		name    string
+		pools   []NodePool
+		wantErr string
+	}{
+		{"valid", []NodePool{control, worker, spot}, ""},
+		{"scale set worker", []NodePool{control, withChanges(worker, func(p *NodePool) { p.ScaleSet = true })}, ""},
+		{"empty worker pool", []NodePool{control, withChanges(worker, func(p *NodePool) { p.Count = 0 })}, ""},
+		{"no name", []NodePool{control, withChanges(worker, func(p *NodePool) { p.Name = "" })}, "has no name"},
+		{"duplicate name", []NodePool{control, withChanges(worker, func(p *NodePool) { p.Name = "control" })}, "used more than once"},
+		{"unknown role", []NodePool{control, withChanges(worker, func(p *NodePool) { p.Role = "etcd" })}, "role must be"},
+		{"negative count", []NodePool{control, withChanges(worker, func(p *NodePool) { p.Count = -1 })}, "must not be negative"},
+		{"no vm size", []NodePool{control, withChanges(worker, func(p *NodePool) { p.VmSize = "" })}, "has no vmSize"},
+		{"control plane scale set", []NodePool{withChanges(control, func(p *NodePool) { p.ScaleSet = true })}, "can't be a scale set"},
+		{"control plane spot", []NodePool{withChanges(control, func(p *NodePool) { p.Spot = true })}, "can't use spot instances"},
+		{"invalid eviction policy", []NodePool{control, withChanges(spot, func(p *NodePool) { p.EvictionPolicy = "Stop" })}, "evictionPolicy must be"},
+		{"invalid max price", []NodePool{control, withChanges(spot, func(p *NodePool) { p.MaxPrice = &invalidPrice })}, "maxPrice must be"},
+		{"no control plane", []NodePool{worker}, "at least one controlplane node"},
+		{"empty control plane", []NodePool{withChanges(control, func(p *NodePool) { p.Count = 0 }), worker}, "at least one controlplane node"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateNodePools(tt.pools)
+			testutil.CheckErr(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestNetworkPrefix(t *testing.T) {
+	tests := []struct {
+		pool NodePool
+		want string
+	}{
+		{NodePool{Name: "control", Role: RoleControlplane, legacy: true}, "controlplane"},
+		{NodePool{Name: "worker", Role: RoleWorker, legacy: true}, "worker"},
+		{NodePool{Name: "control", Role: RoleControlplane}, "control"},
+		{NodePool{Name: "gpu", Role: RoleWorker}, "gpu"},
+	}
+	for _, tt := range tests {
+		if got := tt.pool.NetworkPrefix(); got != tt.want {
+			t.Errorf("NetworkPrefix() of %+v = %q, want %q", tt.pool, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigPatches holds Talos machine config patches, applied in the order global, role, node pool and node.
+// Every patch is either inline YAML or a file path prefixed with "@", and can be a strategic merge patch
+// (a YAML document) or a JSON6902 patch (a list of operations).
+type ConfigPatches struct {
+	Global []string
+	// Roles is keyed by node role, i.e. controlplane or worker
+	Roles map[string][]string
+	// Nodes is keyed by node name, e.g. control-0
+	Nodes map[string][]string
+}
+
+func getConfigPatches(clusterCfg *config.Config, pools []NodePool) (ConfigPatches, error) {
+	var patches ConfigPatches
+	err := clusterCfg.GetObject("configPatches", &patches.Global)
+	if err != nil {
+		return ConfigPatches{}, fmt.Errorf("cluster:configPatches config is invalid, %w", err)
+	}
+	err = clusterCfg.GetObject("rolePatches", &patches.Roles)
+	if err != nil {
+		return ConfigPatches{}, fmt.Errorf("cluster:rolePatches config is invalid, %w", err)
+	}
+	err = clusterCfg.GetObject("nodePatches", &patches.Nodes)
+	if err != nil {
+		return ConfigPatches{}, fmt.Errorf("cluster:nodePatches config is invalid, %w", err)
+	}
+
+	patches.Global, err = loadPatches("cluster:configPatches", patches.Global)
+	if err != nil {
+		return ConfigPatches{}, err
+	}
+	for role, rolePatches := range patches.Roles {
+		if role != RoleControlplane && role != RoleWorker {
+			return ConfigPatches{}, fmt.Errorf("cluster:rolePatches key must be %q or %q, got %q", RoleControlplane, RoleWorker, role)
+		}
+		patches.Roles[role], err = loadPatches("cluster:rolePatches."+role, rolePatches)
+		if err != nil {
+			return ConfigPatches{}, err
+		}
+	}
+
+	nodeNames := map[string]bool{}
+	for _, pool := range pools {
+		// Scale set instances share the configuration of their pool
+		if pool.ScaleSet {
+			continue
+		}
+		for i := 0; i < pool.Count; i++ {
+			nodeNames[pool.NodeName(i)] = true
+		}
+	}
+	for node, nodePatches := range patches.Nodes {
+		if !nodeNames[node] {
+			return ConfigPatches{}, fmt.Errorf("cluster:nodePatches references unknown node %q", node)
+		}
+		patches.Nodes[node], err = loadPatches("cluster:nodePatches."+node, nodePatches)
+		if err != nil {
+			return ConfigPatches{}, err
+		}
+	}
+
+	return patches, nil
+}
+
+// loadPatches reads file patches and makes sure every patch is either a YAML document or a list of operations
+func loadPatches(source string, patches []string) ([]string, error) {
+	loaded := make([]string, len(patches))
+	for i, patch := range patches {
+		if path, ok := strings.CutPrefix(patch, "@"); ok {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%d] patch file could not be read, %w", source, i, err)
+			}
+			patch = string(content)
+		}
+
+		var node yaml.Node
+		if err := yaml.Unmarshal([]byte(patch), &node); err != nil {
+			return nil, fmt.Errorf("%s[%d] is not valid YAML, %w", source, i, err)
+		}
+		if len(node.Content) == 0 || (node.Content[0].Kind != yaml.MappingNode && node.Content[0].Kind != yaml.SequenceNode) {
+			return nil, fmt.Errorf("%s[%d] must be a strategic merge patch or a JSON6902 patch", source, i)
+		}
+		loaded[i] = patch
+	}
+
+	return loaded, nil
+}
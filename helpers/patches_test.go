@@ -0,0 +1,50 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"talos-azure/internal/testutil"
+	"testing"
+)
+
+func TestLoadPatches(t *testing.T) {
+	dir := t.TempDir()
+	patchFile := filepath.Join(dir, "patch.yaml")
+	err := os.WriteFile(patchFile, []byte("machine:\n  sysctls:\n    vm.max_map_count: \"262144\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		patches []string
+		want    []string
+		wantErr string
+	}{
+		{"none", nil, []string{}, ""},
+		{"strategic merge", []string{"machine:\n  kubelet:\n    extraArgs:\n      max-pods: 250"}, []string{"machine:\n  kubelet:\n    extraArgs:\n      max-pods: 250"}, ""},
+		{"json6902", []string{`[{"op": "add", "path": "/machine/network", "value": {}}]`}, []string{`[{"op": "add", "path": "/machine/network", "value": {}}]`}, ""},
+		{"file", []string{"@" + patchFile}, []string{"machine:\n  sysctls:\n    vm.max_map_count: \"262144\"\n"}, ""},
+		{"missing file", []string{"@" + filepath.Join(dir, "missing.yaml")}, nil, "cluster:configPatches[0] patch file could not be read"},
+		{"invalid yaml", []string{"machine: {", "machine: {}"}, nil, "cluster:configPatches[0] is not valid YAML"},
+		{"scalar", []string{"machine: {}", "just a string"}, nil, "cluster:configPatches[1] must be a strategic merge patch or a JSON6902 patch"},
+		{"empty", []string{""}, nil, "cluster:configPatches[0] must be a strategic merge patch or a JSON6902 patch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadPatches("cluster:configPatches", tt.patches)
+			testutil.CheckErr(t, err, tt.wantErr)
+			if tt.wantErr != "" {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d patches, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("patch %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package helpers
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+const DefaultFactoryUrl = "https://factory.talos.dev"
+
+// Schematic customizes the Talos image with system extensions and kernel args through the Image Factory
+type Schematic struct {
+	// Extensions are official system extensions, e.g. siderolabs/iscsi-tools
+	Extensions      []string `json:"extensions"`
+	ExtraKernelArgs []string `json:"extraKernelArgs"`
+	// FactoryUrl is the Image Factory the schematic is created at
+	FactoryUrl string `json:"factoryUrl"`
+	// CustomImage boots the VMs from an image built from the factory disk image
+	CustomImage bool `json:"customImage"`
+}
+
+// ImageArchitecture maps the community gallery image name, e.g. talos-x64, to the architecture of Talos images
+func ImageArchitecture(architecture string) string {
+	if strings.HasSuffix(architecture, "arm64") {
+		return "arm64"
+	}
+	return "amd64"
+}
+
+func getSchematic(clusterCfg *config.Config) (*Schematic, error) {
+	var schematic *Schematic
+	err := clusterCfg.GetObject("schematic", &schematic)
+	if err != nil {
+		return nil, fmt.Errorf("cluster:schematic config is invalid, %w", err)
+	}
+	if schematic == nil {
+		return nil, nil
+	}
+
+	if schematic.FactoryUrl == "" {
+		schematic.FactoryUrl = DefaultFactoryUrl
+	}
+	factoryUrl, err := url.Parse(schematic.FactoryUrl)
+	if err != nil || factoryUrl.Host == "" || (factoryUrl.Scheme != "http" && factoryUrl.Scheme != "https") {
+		return nil, fmt.Errorf("cluster:schematic factoryUrl must be an http or https URL, got %q", schematic.FactoryUrl)
+	}
+	for i, extension := range schematic.Extensions {
+		if extension == "" {
+			return nil, fmt.Errorf("cluster:schematic extensions[%d] is empty", i)
+		}
+	}
+
+	return schematic, nil
+}
@@ -0,0 +1,134 @@
+package helpers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+const (
+	// Built-in rules use priorities within [BuiltinRulePriorityBase, builtinRulePriorityLimit)
+	BuiltinRulePriorityBase  = 1000
+	builtinRulePriorityLimit = 2000
+	minRulePriority          = 100
+	maxRulePriority          = 4096
+)
+
+// builtinRuleNames are the rules the stack creates itself, see network.makeSecurityRules. Extra rules can't reuse
+// them, as both would manage the same rule of the network security group.
+var builtinRuleNames = []string{"apid", "trustd", "etcd", "kube", "trustd-v6", "etcd-v6", "apid-nodes", "kube-nodes"}
+
+// AllowedSources restricts where the Talos and Kubernetes APIs can be reached from.
+// Entries are CIDRs, IPs or Azure service tags. etcd and trustd are always restricted to the node subnets.
+type AllowedSources struct {
+	Talos      []string `json:"talos"`
+	Kubernetes []string `json:"kubernetes"`
+}
+
+// SecurityRule is a user defined network security group rule
+type SecurityRule struct {
+	Name string `json:"name"`
+	// Direction is Inbound or Outbound, defaults to Inbound
+	Direction string `json:"direction"`
+	// Access is Allow or Deny, defaults to Allow
+	Access string `json:"access"`
+	// Protocol is Tcp, Udp, Icmp or *, defaults to Tcp
+	Protocol string `json:"protocol"`
+	// Ports is the destination port or port range, e.g. 30000-32767
+	Ports        string   `json:"ports"`
+	Sources      []string `json:"sources"`
+	Destinations []string `json:"destinations"`
+	// Priority is required, deriving it from the position would shift every later rule when the list changes
+	Priority int `json:"priority"`
+}
+
+func getAllowedSources(networkCfg *config.Config, networkMode string) (AllowedSources, error) {
+	var sources AllowedSources
+	err := networkCfg.GetObject("allowedSources", &sources)
+	if err != nil {
+		return AllowedSources{}, fmt.Errorf("network:allowedSources config is invalid, %w", err)
+	}
+
+	defaultSource := []string{"*"}
+	if networkMode == NetworkModePrivate {
+		defaultSource = []string{"VirtualNetwork"}
+	}
+	if len(sources.Talos) == 0 {
+		sources.Talos = defaultSource
+	}
+	if len(sources.Kubernetes) == 0 {
+		sources.Kubernetes = defaultSource
+	}
+
+	return sources, nil
+}
+
+func getExtraSecurityRules(networkCfg *config.Config) ([]SecurityRule, error) {
+	var rules []SecurityRule
+	err := networkCfg.GetObject("extraRules", &rules)
+	if err != nil {
+		return nil, fmt.Errorf("network:extraRules config is invalid, %w", err)
+	}
+
+	names := map[string]bool{}
+	priorities := map[string]bool{}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			return nil, fmt.Errorf("network:extraRules[%d] has no name", i)
+		}
+		if names[strings.ToLower(rule.Name)] {
+			return nil, fmt.Errorf("network:extraRules name %q is used more than once", rule.Name)
+		}
+		names[strings.ToLower(rule.Name)] = true
+		for _, builtin := range builtinRuleNames {
+			if strings.EqualFold(rule.Name, builtin) {
+				return nil, fmt.Errorf("network:extraRules name %q is used by a built-in rule", rule.Name)
+			}
+		}
+
+		if rule.Direction == "" {
+			rule.Direction = "Inbound"
+		}
+		if rule.Access == "" {
+			rule.Access = "Allow"
+		}
+		if rule.Protocol == "" {
+			rule.Protocol = "Tcp"
+		}
+		if rule.Ports == "" {
+			rule.Ports = "*"
+		}
+		if len(rule.Sources) == 0 {
+			rule.Sources = []string{"*"}
+		}
+		if len(rule.Destinations) == 0 {
+			rule.Destinations = []string{"*"}
+		}
+
+		if !strings.EqualFold(rule.Direction, "Inbound") && !strings.EqualFold(rule.Direction, "Outbound") {
+			return nil, fmt.Errorf("network:extraRules %q direction must be Inbound or Outbound, got %q", rule.Name, rule.Direction)
+		}
+		if !strings.EqualFold(rule.Access, "Allow") && !strings.EqualFold(rule.Access, "Deny") {
+			return nil, fmt.Errorf("network:extraRules %q access must be Allow or Deny, got %q", rule.Name, rule.Access)
+		}
+		if rule.Priority == 0 {
+			return nil, fmt.Errorf("network:extraRules %q has no priority", rule.Name)
+		}
+		if rule.Priority < minRulePriority || rule.Priority > maxRulePriority {
+			return nil, fmt.Errorf("network:extraRules %q priority must be between %d and %d", rule.Name, minRulePriority, maxRulePriority)
+		}
+		if rule.Priority >= BuiltinRulePriorityBase && rule.Priority < builtinRulePriorityLimit {
+			return nil, fmt.Errorf("network:extraRules %q priority %d is reserved for built-in rules", rule.Name, rule.Priority)
+		}
+		// Priorities only have to be unique per direction
+		priorityKey := fmt.Sprintf("%s/%d", strings.ToLower(rule.Direction), rule.Priority)
+		if priorities[priorityKey] {
+			return nil, fmt.Errorf("network:extraRules %q priority %d is used more than once", rule.Name, rule.Priority)
+		}
+		priorities[priorityKey] = true
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,92 @@
+package helpers
+
+import (
+	"talos-azure/internal/testutil"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+func TestGetExtraSecurityRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		want    []SecurityRule
+		wantErr string
+	}{
+		{"unset", "", nil, ""},
+		{
+			"defaults",
+			`[{"name": "nodeports", "ports": "30000-32767", "priority": 2000}, {"name": "dns", "protocol": "Udp", "ports": "53", "priority": 2010}]`,
+			[]SecurityRule{
+				{Name: "nodeports", Direction: "Inbound", Access: "Allow", Protocol: "Tcp", Ports: "30000-32767", Sources: []string{"*"}, Destinations: []string{"*"}, Priority: 2000},
+				{Name: "dns", Direction: "Inbound", Access: "Allow", Protocol: "Udp", Ports: "53", Sources: []string{"*"}, Destinations: []string{"*"}, Priority: 2010},
+			},
+			"",
+		},
+		{
+			"explicit",
+			`[{"name": "deny-smtp", "direction": "Outbound", "access": "Deny", "protocol": "*", "ports": "25", "sources": ["10.0.0.0/16"], "destinations": ["Internet"], "priority": 500}]`,
+			[]SecurityRule{
+				{Name: "deny-smtp", Direction: "Outbound", Access: "Deny", Protocol: "*", Ports: "25", Sources: []string{"10.0.0.0/16"}, Destinations: []string{"Internet"}, Priority: 500},
+			},
+			"",
+		},
+		{"same priority in both directions", `[{"name": "in", "priority": 500}, {"name": "out", "direction": "Outbound", "priority": 500}]`, nil, ""},
+		{"no name", `[{"ports": "80", "priority": 500}]`, nil, "network:extraRules[0] has no name"},
+		{"duplicate name", `[{"name": "web", "priority": 500}, {"name": "Web", "priority": 501}]`, nil, `name "Web" is used more than once`},
+		{"built-in name", `[{"name": "apid", "priority": 500}]`, nil, `name "apid" is used by a built-in rule`},
+		{"built-in name in another case", `[{"name": "Kube-Nodes", "priority": 500}]`, nil, `name "Kube-Nodes" is used by a built-in rule`},
+		{"no priority", `[{"name": "web"}]`, nil, `network:extraRules "web" has no priority`},
+		{"invalid direction", `[{"name": "web", "direction": "Sideways", "priority": 500}]`, nil, "direction must be Inbound or Outbound"},
+		{"invalid access", `[{"name": "web", "access": "Maybe", "priority": 500}]`, nil, "access must be Allow or Deny"},
+		{"priority too low", `[{"name": "web", "priority": 99}]`, nil, "priority must be between 100 and 4096"},
+		{"priority too high", `[{"name": "web", "priority": 4097}]`, nil, "priority must be between 100 and 4096"},
+		{"reserved priority", `[{"name": "web", "priority": 1000}]`, nil, "priority 1000 is reserved for built-in rules"},
+		{"end of the reserved priorities", `[{"name": "web", "priority": 1999}]`, nil, "priority 1999 is reserved for built-in rules"},
+		{"duplicate priority", `[{"name": "web", "priority": 500}, {"name": "ssh", "direction": "inbound", "priority": 500}]`, nil, "priority 500 is used more than once"},
+		{"invalid", `{"name": "web"}`, nil, "network:extraRules config is invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := map[string]string{}
+			if tt.rules != "" {
+				values["network:extraRules"] = tt.rules
+			}
+			testutil.WithConfig(t, values, func(ctx *pulumi.Context) error {
+				got, err := getExtraSecurityRules(config.New(ctx, "network"))
+				testutil.CheckErr(t, err, tt.wantErr)
+				if tt.wantErr != "" || tt.want == nil {
+					return nil
+				}
+				if len(got) != len(tt.want) {
+					t.Fatalf("got %d rules, want %d", len(got), len(tt.want))
+				}
+				for i := range got {
+					if !equalRules(got[i], tt.want[i]) {
+						t.Errorf("rule %d = %+v, want %+v", i, got[i], tt.want[i])
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func equalRules(a SecurityRule, b SecurityRule) bool {
+	return a.Name == b.Name && a.Direction == b.Direction && a.Access == b.Access && a.Protocol == b.Protocol &&
+		a.Ports == b.Ports && a.Priority == b.Priority && equalStrings(a.Sources, b.Sources) && equalStrings(a.Destinations, b.Destinations)
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
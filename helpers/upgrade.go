@@ -0,0 +1,39 @@
+package helpers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// Upgrade configures the rolling in-place upgrades of Talos
+type Upgrade struct {
+	// WorkerBatchSize is the number of workers upgraded at the same time, control plane nodes go one by one
+	WorkerBatchSize int `json:"workerBatchSize"`
+	// Timeout is the time a single node may take to upgrade and become healthy, e.g. 15m
+	Timeout string `json:"timeout"`
+}
+
+func getUpgrade(clusterCfg *config.Config) (Upgrade, error) {
+	var upgrade Upgrade
+	err := clusterCfg.GetObject("upgrade", &upgrade)
+	if err != nil {
+		return Upgrade{}, fmt.Errorf("cluster:upgrade config is invalid, %w", err)
+	}
+
+	if upgrade.WorkerBatchSize == 0 {
+		upgrade.WorkerBatchSize = 1
+	}
+	if upgrade.WorkerBatchSize < 0 {
+		return Upgrade{}, fmt.Errorf("cluster:upgrade workerBatchSize must be positive, got %d", upgrade.WorkerBatchSize)
+	}
+	if upgrade.Timeout == "" {
+		upgrade.Timeout = "15m"
+	}
+	if _, err := time.ParseDuration(upgrade.Timeout); err != nil {
+		return Upgrade{}, fmt.Errorf("cluster:upgrade timeout must be a duration such as 15m, %w", err)
+	}
+
+	return upgrade, nil
+}
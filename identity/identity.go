@@ -0,0 +1,108 @@
+package identity
+
+import (
+	"fmt"
+	"strings"
+	"talos-azure/helpers"
+
+	"github.com/pulumi/pulumi-azure-native-sdk/authorization/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/managedidentity/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/resources/v2"
+	"github.com/pulumi/pulumi-random/sdk/v4/go/random"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// UserAssigned is a user assigned managed identity
+type UserAssigned struct {
+	Resource    *managedidentity.UserAssignedIdentity
+	Id          pulumi.StringOutput
+	ClientId    pulumi.StringOutput
+	PrincipalId pulumi.StringOutput
+	TenantId    pulumi.StringOutput
+}
+
+type Params struct {
+	ResourceGroup *resources.ResourceGroup
+	Location      string
+}
+
+// NewUserAssigned creates a user assigned identity called identityName in the resource group of the stack
+func NewUserAssigned(ctx *pulumi.Context, name string, identityName string, params Params) (UserAssigned, error) {
+	identity, err := managedidentity.NewUserAssignedIdentity(ctx, name, &managedidentity.UserAssignedIdentityArgs{
+		ResourceGroupName: params.ResourceGroup.Name,
+		ResourceName:      pulumi.String(identityName),
+		Location:          pulumi.String(params.Location),
+	})
+	if err != nil {
+		return UserAssigned{}, err
+	}
+
+	return UserAssigned{
+		Resource:    identity,
+		Id:          identity.ID().ToStringOutput(),
+		ClientId:    identity.ClientId,
+		PrincipalId: identity.PrincipalId,
+		TenantId:    identity.TenantId,
+	}, nil
+}
+
+// NewRoleAssignment grants the principal the role with the given definition GUID on the scope ID, or on the
+// resource group of the stack for an empty scope
+func NewRoleAssignment(
+	ctx *pulumi.Context,
+	name string,
+	params Params,
+	scopeId string,
+	roleId string,
+	principalId pulumi.StringInput,
+) (*authorization.RoleAssignment, error) {
+	// Role assignment names have to be GUIDs
+	assignmentName, err := random.NewRandomUuid(ctx, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	var scope pulumi.StringInput = params.ResourceGroup.ID().ToStringOutput()
+	if scopeId != "" {
+		// Role definitions are referenced within the subscription of the stack, so the scope has to be in it as well
+		scope = SubscriptionId(params.ResourceGroup).ApplyT(func(subscriptionId string) (string, error) {
+			parts := strings.Split(strings.Trim(scopeId, "/"), "/")
+			if !strings.EqualFold(parts[1], subscriptionId) {
+				return "", fmt.Errorf("role assignment scope %s is in subscription %s, but the stack deploys to subscription %s",
+					scopeId, parts[1], subscriptionId)
+			}
+			return scopeId, nil
+		}).(pulumi.StringOutput)
+	}
+
+	return authorization.NewRoleAssignment(ctx, name, &authorization.RoleAssignmentArgs{
+		RoleAssignmentName: assignmentName.Result,
+		Scope:              scope,
+		RoleDefinitionId:   pulumi.Sprintf("/subscriptions/%s/providers/Microsoft.Authorization/roleDefinitions/%s", SubscriptionId(params.ResourceGroup), roleId),
+		PrincipalId:        principalId,
+		PrincipalType:      pulumi.String(authorization.PrincipalTypeServicePrincipal),
+	})
+}
+
+// AssignRoles creates the role assignments of a node identity, named <name>-role-<index>
+func AssignRoles(ctx *pulumi.Context, name string, params Params, assignments []helpers.RoleAssignment, principalId pulumi.StringInput) ([]*authorization.RoleAssignment, error) {
+	roleAssignments := make([]*authorization.RoleAssignment, len(assignments))
+	for i, assignment := range assignments {
+		roleAssignment, err := NewRoleAssignment(ctx, fmt.Sprintf("%s-role-%d", name, i), params, assignment.ScopeId, assignment.RoleId, principalId)
+		if err != nil {
+			return nil, err
+		}
+		roleAssignments[i] = roleAssignment
+	}
+	return roleAssignments, nil
+}
+
+// SubscriptionId extracts the subscription id from the id of the resource group
+func SubscriptionId(resourceGroup *resources.ResourceGroup) pulumi.StringOutput {
+	return resourceGroup.ID().ApplyT(func(id pulumi.ID) (string, error) {
+		parts := strings.Split(strings.Trim(string(id), "/"), "/")
+		if len(parts) < 2 || !strings.EqualFold(parts[0], "subscriptions") {
+			return "", fmt.Errorf("unexpected resource group id %q", id)
+		}
+		return parts[1], nil
+	}).(pulumi.StringOutput)
+}
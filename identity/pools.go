@@ -0,0 +1,94 @@
+package identity
+
+import (
+	"fmt"
+	"talos-azure/helpers"
+
+	"github.com/pulumi/pulumi-azure-native-sdk/compute/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/resources/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+type ProvisionPoolIdentitiesParams struct {
+	ResourceGroup *resources.ResourceGroup
+}
+
+// ProvisionPoolIdentities creates the user assigned identities of node pools along with their role
+// assignments, keyed by pool name
+func ProvisionPoolIdentities(ctx *pulumi.Context, params ProvisionPoolIdentitiesParams) (map[string]UserAssigned, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	identityParams := Params{ResourceGroup: params.ResourceGroup, Location: conf.AzRegion}
+	identities := map[string]UserAssigned{}
+	for _, pool := range conf.NodePools {
+		if pool.Identity == nil || pool.Identity.Type != helpers.IdentityTypeUserAssigned {
+			continue
+		}
+		name := fmt.Sprintf("%s-identity", pool.Name)
+		userAssigned, err := NewUserAssigned(ctx, name, name, identityParams)
+		if err != nil {
+			return nil, err
+		}
+		_, err = AssignRoles(ctx, name, identityParams, pool.Identity.RoleAssignments, userAssigned.PrincipalId)
+		if err != nil {
+			return nil, err
+		}
+		identities[pool.Name] = userAssigned
+	}
+
+	return identities, nil
+}
+
+type AssignSystemRolesParams struct {
+	ResourceGroup *resources.ResourceGroup
+	// PoolNodes and PoolScaleSets are the compute resources of every pool, keyed by pool name
+	PoolNodes     map[string][]*compute.VirtualMachine
+	PoolScaleSets map[string][]*compute.VirtualMachineScaleSet
+}
+
+// AssignSystemRoles grants the roles of pools with system assigned identities to every VM, or once to each
+// scale set of the pool. It returns the principal ids of the identities, keyed by pool name.
+func AssignSystemRoles(ctx *pulumi.Context, params AssignSystemRolesParams) (map[string]pulumi.StringArray, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	identityParams := Params{ResourceGroup: params.ResourceGroup, Location: conf.AzRegion}
+	principalIds := map[string]pulumi.StringArray{}
+	for _, pool := range conf.NodePools {
+		if pool.Identity == nil || pool.Identity.Type != helpers.IdentityTypeSystemAssigned {
+			continue
+		}
+
+		ids := pulumi.StringArray{}
+		scaleSets := params.PoolScaleSets[pool.Name]
+		for i, scaleSet := range scaleSets {
+			// Pools without zones have a single scale set and keep the name from before scale sets per zone
+			name := fmt.Sprintf("%s-identity", pool.Name)
+			if len(scaleSets) > 1 {
+				name = fmt.Sprintf("%s-vmss-%s-identity", pool.Name, conf.Zones[i])
+			}
+			principalId := scaleSet.Identity.PrincipalId().Elem()
+			_, err = AssignRoles(ctx, name, identityParams, pool.Identity.RoleAssignments, principalId)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, principalId)
+		}
+		for i, node := range params.PoolNodes[pool.Name] {
+			principalId := node.Identity.PrincipalId().Elem()
+			_, err = AssignRoles(ctx, fmt.Sprintf("%s-identity", pool.NodeName(i)), identityParams, pool.Identity.RoleAssignments, principalId)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, principalId)
+		}
+		principalIds[pool.Name] = ids
+	}
+
+	return principalIds, nil
+}
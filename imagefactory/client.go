@@ -0,0 +1,140 @@
+package imagefactory
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"talos-azure/helpers"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Client talks to the Talos Image Factory API. The base URL can point at any server implementing the
+// schematics and image endpoints, e.g. a local stand-in.
+type Client struct {
+	baseUrl    *url.URL
+	httpClient *http.Client
+}
+
+func NewClient(baseUrl string, httpClient *http.Client) (*Client, error) {
+	parsed, err := url.Parse(strings.TrimSuffix(baseUrl, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image factory URL %q: %w", baseUrl, err)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{baseUrl: parsed, httpClient: httpClient}, nil
+}
+
+// schematicRequest mirrors the schematic of the factory, which derives IDs from the hash of its YAML encoding
+type schematicRequest struct {
+	Customization struct {
+		ExtraKernelArgs  []string `yaml:"extraKernelArgs,omitempty"`
+		SystemExtensions struct {
+			OfficialExtensions []string `yaml:"officialExtensions,omitempty"`
+		} `yaml:"systemExtensions,omitempty"`
+	} `yaml:"customization"`
+}
+
+func schematicBody(schematic helpers.Schematic) ([]byte, error) {
+	var request schematicRequest
+	request.Customization.ExtraKernelArgs = schematic.ExtraKernelArgs
+	request.Customization.SystemExtensions.OfficialExtensions = schematic.Extensions
+	body, err := yaml.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build schematic: %w", err)
+	}
+	return body, nil
+}
+
+// SchematicId computes the ID the factory assigns to the schematic without registering it
+func SchematicId(schematic helpers.Schematic) (string, error) {
+	body, err := schematicBody(schematic)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// CreateSchematic registers the schematic and returns its ID. IDs are derived from the content, so creating
+// the same schematic again returns the same ID.
+func (c *Client) CreateSchematic(ctx context.Context, schematic helpers.Schematic) (string, error) {
+	body, err := schematicBody(schematic)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseUrl.JoinPath("schematics").String(), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/yaml")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to create schematic: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("failed to create schematic: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	var created struct {
+		Id string `json:"id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode schematic response: %w", err)
+	}
+	if created.Id == "" {
+		return "", fmt.Errorf("image factory returned no schematic ID")
+	}
+	return created.Id, nil
+}
+
+// Versions lists the Talos versions the factory builds images for, e.g. v1.7.6
+func (c *Client) Versions(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseUrl.JoinPath("versions").String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Talos versions: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list Talos versions: %s", resp.Status)
+	}
+
+	var versions []string
+	err = json.NewDecoder(resp.Body).Decode(&versions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode Talos versions: %w", err)
+	}
+	return versions, nil
+}
+
+// InstallerImage returns the installer image reference of the schematic, which the factory also serves as registry
+func (c *Client) InstallerImage(schematicId string, version string) string {
+	return fmt.Sprintf("%s/installer/%s:%s", c.baseUrl.Host, schematicId, tag(version))
+}
+
+// DiskImageUrl returns the URL of the xz compressed Azure disk image of the schematic
+func (c *Client) DiskImageUrl(schematicId string, version string, arch string) string {
+	return c.baseUrl.JoinPath("image", schematicId, tag(version), fmt.Sprintf("azure-%s.vhd.xz", arch)).String()
+}
+
+// tag prefixes versions with v, cluster:talos-version is given without one
+func tag(version string) string {
+	return "v" + strings.TrimPrefix(version, "v")
+}
@@ -0,0 +1,133 @@
+package imagefactory
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"talos-azure/helpers"
+	"talos-azure/internal/testutil"
+	"testing"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client, err := NewClient(server.URL+"/", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestSchematicId(t *testing.T) {
+	// The ID the factory assigns to the schematic without customizations
+	id, err := SchematicId(helpers.Schematic{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "376567988ad370138ad8b2698212367b8edcb69b5fd68c80be1f2ec7d603b4ba"; id != want {
+		t.Errorf("SchematicId() = %s, want %s", id, want)
+	}
+
+	extended, err := SchematicId(helpers.Schematic{Extensions: []string{"siderolabs/iscsi-tools"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extended == id {
+		t.Errorf("SchematicId() with extensions matches the vanilla schematic ID")
+	}
+}
+
+func TestCreateSchematic(t *testing.T) {
+	schematic := helpers.Schematic{
+		Extensions:      []string{"siderolabs/iscsi-tools"},
+		ExtraKernelArgs: []string{"console=ttyS0"},
+	}
+	wantBody, err := schematicBody(schematic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		status   int
+		response string
+		want     string
+		wantErr  string
+	}{
+		{"created", http.StatusCreated, `{"id": "abc"}`, "abc", ""},
+		{"existing", http.StatusOK, `{"id": "abc"}`, "abc", ""},
+		{"error", http.StatusBadRequest, "unknown extension\n", "", "failed to create schematic: 400 Bad Request: unknown extension"},
+		{"invalid JSON", http.StatusCreated, `{"id":`, "", "failed to decode schematic response"},
+		{"no ID", http.StatusCreated, `{}`, "", "image factory returned no schematic ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if r.Method != http.MethodPost || r.URL.Path != "/schematics" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				if string(body) != string(wantBody) {
+					t.Errorf("request body = %q, want %q", body, wantBody)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.response)
+			})
+
+			got, err := client.CreateSchematic(context.Background(), schematic)
+			testutil.CheckErr(t, err, tt.wantErr)
+			if got != tt.want {
+				t.Errorf("CreateSchematic() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersions(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response string
+		want     []string
+		wantErr  string
+	}{
+		{"ok", http.StatusOK, `["v1.7.5", "v1.7.6", "v1.8.0-alpha.1"]`, []string{"v1.7.5", "v1.7.6", "v1.8.0-alpha.1"}, ""},
+		{"error", http.StatusServiceUnavailable, "", nil, "failed to list Talos versions: 503 Service Unavailable"},
+		{"invalid JSON", http.StatusOK, `{"versions": []}`, nil, "failed to decode Talos versions"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || r.URL.Path != "/versions" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.response)
+			})
+
+			got, err := client.Versions(context.Background())
+			testutil.CheckErr(t, err, tt.wantErr)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Versions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageReferences(t *testing.T) {
+	client, err := NewClient("https://factory.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := client.InstallerImage("abc", "1.7.6"), "factory.example.com/installer/abc:v1.7.6"; got != want {
+		t.Errorf("InstallerImage() = %s, want %s", got, want)
+	}
+	if got, want := client.DiskImageUrl("abc", "v1.7.6", "arm64"), "https://factory.example.com/image/abc/v1.7.6/azure-arm64.vhd.xz"; got != want {
+		t.Errorf("DiskImageUrl() = %s, want %s", got, want)
+	}
+}
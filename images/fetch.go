@@ -0,0 +1,113 @@
+package images
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// FetchVhd makes the VHD at source available at path. Sources are local paths or http(s) URLs, xz compressed
+// ones are decompressed as Azure only accepts uncompressed VHDs. Local uncompressed VHDs are used in place and
+// files already at path are reused.
+func FetchVhd(ctx context.Context, httpClient *http.Client, source string, path string) (string, error) {
+	if isLocalVhd(source) {
+		return source, nil
+	}
+	isUrl := isUrl(source)
+	compressed := strings.HasSuffix(source, ".xz")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create image directory %s: %w", filepath.Dir(path), err)
+	}
+
+	if isUrl {
+		download := path + ".download"
+		err = downloadFile(ctx, httpClient, source, download)
+		if err != nil {
+			return "", err
+		}
+		if !compressed {
+			return path, os.Rename(download, path)
+		}
+		defer os.Remove(download)
+		source = download
+	}
+
+	return path, decompressXz(source, path)
+}
+
+// isLocalVhd reports whether source is a local uncompressed VHD, which is used in place
+func isLocalVhd(source string) bool {
+	return !isUrl(source) && !strings.HasSuffix(source, ".xz")
+}
+
+func isUrl(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+func downloadFile(ctx context.Context, httpClient *http.Client, url string, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	return nil
+}
+
+// decompressXz decompresses into a temporary file first, so interrupted runs don't leave truncated VHDs behind
+func decompressXz(source string, path string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", source, err)
+	}
+	defer in.Close()
+	reader, err := xz.NewReader(bufio.NewReader(in))
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", source, err)
+	}
+
+	partial := path + ".partial"
+	file, err := os.Create(partial)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", partial, err)
+	}
+	defer os.Remove(partial)
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", source, err)
+	}
+	return os.Rename(partial, path)
+}
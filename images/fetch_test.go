@@ -0,0 +1,119 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"talos-azure/internal/testutil"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func compressXz(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	writer, err := xz.NewWriter(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func TestFetchVhd(t *testing.T) {
+	vhd := bytes.Repeat([]byte("talos"), 1024)
+	compressed := compressXz(t, vhd)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/azure-amd64.vhd":
+			w.Write(vhd)
+		case "/azure-amd64.vhd.xz":
+			w.Write(compressed)
+		case "/invalid.vhd.xz":
+			w.Write(vhd)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	localDir := t.TempDir()
+	localVhd := filepath.Join(localDir, "local.vhd")
+	localXz := filepath.Join(localDir, "local.vhd.xz")
+	if err := os.WriteFile(localVhd, vhd, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(localXz, compressed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		source  string
+		inPlace bool
+		wantErr string
+	}{
+		{"url", server.URL + "/azure-amd64.vhd", false, ""},
+		{"compressed url", server.URL + "/azure-amd64.vhd.xz", false, ""},
+		{"local", localVhd, true, ""},
+		{"compressed local", localXz, false, ""},
+		{"not found", server.URL + "/missing.vhd.xz", false, "404 Not Found"},
+		{"not compressed", server.URL + "/invalid.vhd.xz", false, "failed to decompress"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "images", "talos.vhd")
+			got, err := FetchVhd(context.Background(), server.Client(), tt.source, path)
+			testutil.CheckErr(t, err, tt.wantErr)
+			if tt.wantErr != "" {
+				entries, _ := os.ReadDir(filepath.Dir(path))
+				if len(entries) != 0 {
+					t.Errorf("failed fetch left %d files behind", len(entries))
+				}
+				return
+			}
+			want := path
+			if tt.inPlace {
+				want = tt.source
+			}
+			if got != want {
+				t.Fatalf("FetchVhd() = %s, want %s", got, want)
+			}
+			data, err := os.ReadFile(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, vhd) {
+				t.Errorf("fetched VHD differs from the source")
+			}
+		})
+	}
+}
+
+func TestFetchVhdReusesFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request for %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "talos.vhd")
+	if err := os.WriteFile(path, []byte("cached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := FetchVhd(context.Background(), server.Client(), server.URL+"/azure-amd64.vhd.xz", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != path {
+		t.Errorf("FetchVhd() = %s, want %s", got, path)
+	}
+}
@@ -0,0 +1,325 @@
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"talos-azure/helpers"
+	"talos-azure/imagefactory"
+	"time"
+
+	compute "github.com/pulumi/pulumi-azure-native-sdk/compute/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/resources/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/storage/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Schematic is an Image Factory schematic resolved to its ID
+type Schematic struct {
+	Id string
+	// InstallerImage is used for installs and upgrades, so the extensions survive upgrades
+	InstallerImage string
+	// DiskImageUrl is the xz compressed Azure disk image of the schematic
+	DiskImageUrl string
+}
+
+// ResolveSchematic creates the configured schematic at the Image Factory on update, it returns nil without
+// cluster:schematic. Schematic IDs are derived from their content, so resolving on every run is stable.
+// talosVersion is the resolved cluster:talos-version the installer and disk image are built for.
+func ResolveSchematic(ctx *pulumi.Context, talosVersion string) (*Schematic, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Schematic == nil {
+		return nil, nil
+	}
+
+	client, err := imagefactory.NewClient(conf.Schematic.FactoryUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Previews don't register anything, the ID is derived from the content the same way the factory does
+	var id string
+	if ctx.DryRun() {
+		id, err = imagefactory.SchematicId(*conf.Schematic)
+	} else {
+		id, err = client.CreateSchematic(ctx.Context(), *conf.Schematic)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Schematic{
+		Id:             id,
+		InstallerImage: client.InstallerImage(id, talosVersion),
+		DiskImageUrl:   client.DiskImageUrl(id, talosVersion, helpers.ImageArchitecture(conf.Architecture)),
+	}, nil
+}
+
+// Vhd is a local, uncompressed Talos disk image
+type Vhd struct {
+	// Path doesn't exist yet during previews, VHDs are only fetched on update
+	Path string
+	// Name identifies the content of the VHD, a new name uploads a new blob and replaces the image.
+	// It contains a hash of the source, so a changed source is never mistaken for a fetched or uploaded VHD.
+	Name string
+}
+
+// ResolveVhd fetches the disk image VMs boot from instead of the community gallery image. That's the source of
+// cluster:imageGallery, or the disk image of the schematic with customImage. Without either the Vhd is empty.
+func ResolveVhd(ctx *pulumi.Context, schematic *Schematic, talosVersion string) (Vhd, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return Vhd{}, err
+	}
+
+	var source, name string
+	switch {
+	case conf.ImageGallery != nil && conf.ImageGallery.Source != "":
+		source = conf.ImageGallery.Source
+		// Release assets share their file name across versions
+		baseName := strings.TrimSuffix(strings.TrimSuffix(path.Base(source), ".xz"), ".vhd")
+		name = fmt.Sprintf("talos-%s-%s-%s", conf.ImageGallery.ImageVersion(talosVersion), baseName, sourceHash(source))
+	case schematic != nil && conf.Schematic.CustomImage:
+		source = schematic.DiskImageUrl
+		name = fmt.Sprintf("talos-%s-%s-%s", schematic.Id, talosVersion, sourceHash(source))
+	default:
+		return Vhd{}, nil
+	}
+
+	// Downloads are skipped during previews, the upload only happens on update anyway
+	vhdPath := filepath.Join(conf.ImageDir, name+".vhd")
+	if isLocalVhd(source) {
+		vhdPath = source
+	} else if !ctx.DryRun() {
+		vhdPath, err = FetchVhd(ctx.Context(), http.DefaultClient, source, vhdPath)
+		if err != nil {
+			return Vhd{}, err
+		}
+	}
+	return Vhd{vhdPath, name}, nil
+}
+
+// sourceHash shortens the hash of the source path or URL to 8 hex digits
+func sourceHash(source string) string {
+	hash := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(hash[:4])
+}
+
+// Gallery image versions consist of three 32 bit integers. The minor field holds the minor and patch version,
+// galleryPatchFactor keeps them ordered, the patch field holds the hash of the VHD.
+const (
+	galleryPatchFactor = 1000
+	maxGalleryMinor    = math.MaxInt32/galleryPatchFactor - 1
+)
+
+type ProvisionImageParams struct {
+	ResourceGroup  *resources.ResourceGroup
+	StorageAccount *storage.StorageAccount
+	Vhd            Vhd
+	// TalosVersion is the resolved cluster:talos-version, gallery image versions are named after it by default
+	TalosVersion string
+}
+
+type Image struct {
+	Container *storage.BlobContainer
+	// BlobUri is the uploaded VHD, without credentials
+	BlobUri pulumi.StringOutput
+	// Id is the managed image or gallery image version VMs boot from
+	Id pulumi.StringOutput
+}
+
+// ProvisionImage uploads the VHD into the images container of the storage account and creates a gallery image
+// version from it with cluster:imageGallery, or a managed image otherwise.
+func ProvisionImage(ctx *pulumi.Context, params ProvisionImageParams) (Image, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return Image{}, err
+	}
+
+	container, blobUri, err := uploadVhd(ctx, params)
+	if err != nil {
+		return Image{}, err
+	}
+
+	var imageId pulumi.StringOutput
+	if conf.ImageGallery != nil {
+		imageId, err = provisionGalleryImage(ctx, conf, params, blobUri)
+	} else {
+		imageId, err = provisionManagedImage(ctx, conf, params, blobUri)
+	}
+	if err != nil {
+		return Image{}, err
+	}
+
+	return Image{container, blobUri, imageId}, nil
+}
+
+// uploadVhd uploads the VHD on update only, uploads are skipped when the blob was uploaded before. The Blob resource
+// of azure-native only creates block and append blobs, while images can only be created from page blobs.
+func uploadVhd(ctx *pulumi.Context, params ProvisionImageParams) (*storage.BlobContainer, pulumi.StringOutput, error) {
+	container, err := storage.NewBlobContainer(ctx, "images", &storage.BlobContainerArgs{
+		ResourceGroupName: params.ResourceGroup.Name,
+		AccountName:       params.StorageAccount.Name,
+		ContainerName:     pulumi.String("images"),
+		PublicAccess:      storage.PublicAccessNone,
+	})
+	if err != nil {
+		return nil, pulumi.StringOutput{}, err
+	}
+
+	blobName := fmt.Sprintf("%s.vhd", params.Vhd.Name)
+	blobUri := pulumi.All(
+		params.ResourceGroup.Name,
+		params.StorageAccount.Name,
+		params.StorageAccount.PrimaryEndpoints.Blob(),
+		container.Name,
+	).ApplyT(func(args []interface{}) (string, error) {
+		accountName := args[1].(string)
+		blobUri := fmt.Sprintf("%s%s/%s", args[2].(string), args[3].(string), blobName)
+		if ctx.DryRun() {
+			return blobUri, nil
+		}
+
+		// The token is only used for the upload and never stored
+		https := storage.HttpProtocolHttps
+		sas, err := storage.ListStorageAccountSAS(ctx, &storage.ListStorageAccountSASArgs{
+			ResourceGroupName:      args[0].(string),
+			AccountName:            accountName,
+			Services:               "b",
+			ResourceTypes:          "o",
+			Permissions:            "rwc",
+			Protocols:              &https,
+			SharedAccessExpiryTime: time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return "", err
+		}
+		err = uploadPageBlob(ctx.Context(), http.DefaultClient, blobUri+"?"+sas.AccountSasToken, params.Vhd.Path)
+		if err != nil {
+			return "", fmt.Errorf("failed to upload %s to %s: %w", params.Vhd.Path, blobUri, err)
+		}
+		return blobUri, nil
+	}).(pulumi.StringOutput)
+
+	return container, blobUri, nil
+}
+
+func provisionManagedImage(ctx *pulumi.Context, conf helpers.CustomConfig, params ProvisionImageParams, blobUri pulumi.StringOutput) (pulumi.StringOutput, error) {
+	image, err := compute.NewImage(ctx, "talos-image", &compute.ImageArgs{
+		ResourceGroupName: params.ResourceGroup.Name,
+		Location:          pulumi.String(conf.AzRegion),
+		HyperVGeneration:  pulumi.String("V1"),
+		StorageProfile: compute.ImageStorageProfileArgs{
+			OsDisk: compute.ImageOSDiskArgs{
+				OsType:  compute.OperatingSystemTypesLinux,
+				OsState: compute.OperatingSystemStateTypesGeneralized,
+				BlobUri: blobUri,
+			},
+		},
+	})
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+	return image.ID().ToStringOutput(), nil
+}
+
+// provisionGalleryImage creates the gallery, an image definition for the architecture and the image version,
+// replicated to the region of the stack and the configured replication regions
+func provisionGalleryImage(ctx *pulumi.Context, conf helpers.CustomConfig, params ProvisionImageParams, blobUri pulumi.StringOutput) (pulumi.StringOutput, error) {
+	gallery, err := compute.NewGallery(ctx, "image-gallery", &compute.GalleryArgs{
+		ResourceGroupName: params.ResourceGroup.Name,
+		Location:          pulumi.String(conf.AzRegion),
+		GalleryName:       pulumi.String(conf.ImageGallery.GalleryName),
+		Description:       pulumi.String("Talos images"),
+	})
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	architecture := compute.ArchitectureX64
+	if helpers.ImageArchitecture(conf.Architecture) == "arm64" {
+		architecture = compute.ArchitectureArm64
+	}
+	galleryImage, err := compute.NewGalleryImage(ctx, "image-definition", &compute.GalleryImageArgs{
+		ResourceGroupName: params.ResourceGroup.Name,
+		Location:          pulumi.String(conf.AzRegion),
+		GalleryName:       gallery.Name,
+		GalleryImageName:  pulumi.String(conf.Architecture),
+		Architecture:      pulumi.String(architecture),
+		HyperVGeneration:  pulumi.String("V1"),
+		OsType:            compute.OperatingSystemTypesLinux,
+		OsState:           compute.OperatingSystemStateTypesGeneralized,
+		Identifier: compute.GalleryImageIdentifierArgs{
+			Publisher: pulumi.String("siderolabs"),
+			Offer:     pulumi.String("talos"),
+			Sku:       pulumi.String(conf.Architecture),
+		},
+	})
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	targetRegions := compute.TargetRegionArray{compute.TargetRegionArgs{Name: pulumi.String(conf.AzRegion)}}
+	for _, region := range conf.ImageGallery.ReplicationRegions {
+		if region != conf.AzRegion {
+			targetRegions = append(targetRegions, compute.TargetRegionArgs{Name: pulumi.String(region)})
+		}
+	}
+	versionName, err := galleryVersionName(conf.ImageGallery.ImageVersion(params.TalosVersion), params.Vhd.Name)
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+	// A changed VHD gets a new version name, so the new version is created before the old one, which VMs and
+	// scale sets may still reference, is deleted
+	version, err := compute.NewGalleryImageVersion(ctx, "image-version", &compute.GalleryImageVersionArgs{
+		ResourceGroupName:       params.ResourceGroup.Name,
+		Location:                pulumi.String(conf.AzRegion),
+		GalleryName:             gallery.Name,
+		GalleryImageName:        galleryImage.Name,
+		GalleryImageVersionName: pulumi.String(versionName),
+		PublishingProfile: compute.GalleryImageVersionPublishingProfileArgs{
+			TargetRegions: targetRegions,
+		},
+		StorageProfile: compute.GalleryImageVersionStorageProfileArgs{
+			OsDiskImage: compute.GalleryOSDiskImageArgs{
+				HostCaching: compute.HostCachingReadOnly,
+				Source: compute.GalleryDiskImageSourceArgs{
+					Uri:              blobUri,
+					StorageAccountId: params.StorageAccount.ID(),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+	return version.ID().ToStringOutput(), nil
+}
+
+// galleryVersionName moves the patch version into the minor field and uses a 31 bit hash of the VHD name as patch
+// field, e.g. 1.7.6 becomes 1.7006.1864203381. Versions stay ordered by their Talos version while different VHDs of
+// the same version practically never share a gallery version.
+func galleryVersionName(version string, vhdName string) (string, error) {
+	var major, minor, patch int
+	_, err := fmt.Sscanf(version, "%d.%d.%d", &major, &minor, &patch)
+	if err != nil {
+		return "", fmt.Errorf("invalid gallery image version %q: %w", version, err)
+	}
+	if patch >= galleryPatchFactor {
+		return "", fmt.Errorf("gallery image version %q has a patch version above %d", version, galleryPatchFactor-1)
+	}
+	if minor > maxGalleryMinor {
+		return "", fmt.Errorf("gallery image version %q has a minor version above %d", version, maxGalleryMinor)
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(vhdName))
+	return fmt.Sprintf("%d.%d.%d", major, minor*galleryPatchFactor+patch, hash.Sum32()&math.MaxInt32), nil
+}
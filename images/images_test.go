@@ -0,0 +1,69 @@
+package images
+
+import (
+	"fmt"
+	"strings"
+	"talos-azure/internal/testutil"
+	"testing"
+)
+
+func TestGalleryVersionName(t *testing.T) {
+	name, err := galleryVersionName("1.7.6", "talos-1.7.6-azure-amd64-0011aabb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(name, "1.7006.") {
+		t.Errorf("galleryVersionName() = %s, want 1.7006 followed by the hash", name)
+	}
+	again, err := galleryVersionName("1.7.6", "talos-1.7.6-azure-amd64-0011aabb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != name {
+		t.Errorf("galleryVersionName() isn't stable, got %s and %s", name, again)
+	}
+
+	zeroPatch, err := galleryVersionName("1.8.0", "talos-1.8.0-azure-amd64-0011aabb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(zeroPatch, "1.8000.") {
+		t.Errorf("galleryVersionName() = %s, want 1.8000 followed by the hash", zeroPatch)
+	}
+	if zeroPatch <= name {
+		t.Errorf("galleryVersionName() of 1.8.0 = %s isn't ordered after %s of 1.7.6", zeroPatch, name)
+	}
+
+	maxMinor, err := galleryVersionName(fmt.Sprintf("1.%d.999", maxGalleryMinor), "talos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var major, minor, patch int32
+	_, err = fmt.Sscanf(maxMinor, "%d.%d.%d", &major, &minor, &patch)
+	if err != nil || minor < 0 || patch < 0 {
+		t.Errorf("galleryVersionName() = %s overflows 32 bit fields", maxMinor)
+	}
+
+	_, err = galleryVersionName("1.7.1000", "talos")
+	testutil.CheckErr(t, err, "has a patch version above 999")
+	_, err = galleryVersionName(fmt.Sprintf("1.%d.0", maxGalleryMinor+1), "talos")
+	testutil.CheckErr(t, err, "has a minor version above")
+	_, err = galleryVersionName("latest", "talos")
+	testutil.CheckErr(t, err, `invalid gallery image version "latest"`)
+}
+
+func TestGalleryVersionNameDistinctSources(t *testing.T) {
+	// VHD names of the same Talos version only differ in the schematic and the hash of their source
+	seen := map[string]string{}
+	for i := 0; i < 10000; i++ {
+		vhdName := fmt.Sprintf("talos-1.7.6-azure-amd64-%s", sourceHash(fmt.Sprintf("https://example.com/talos-%d.vhd", i)))
+		name, err := galleryVersionName("1.7.6", vhdName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, ok := seen[name]; ok {
+			t.Fatalf("%s and %s both get gallery version %s", other, vhdName, name)
+		}
+		seen[name] = vhdName
+	}
+}
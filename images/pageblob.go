@@ -0,0 +1,135 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+const (
+	// pageSize is the largest range a single Put Page request accepts
+	pageSize = 4 * 1024 * 1024
+	// uploadedMetadata marks blobs whose upload completed, so interrupted uploads are retried
+	uploadedMetadata = "x-ms-meta-talosuploaded"
+	blobApiVersion   = "2021-08-06"
+)
+
+// uploadPageBlob uploads the VHD at path as a page blob, as Azure only creates images from page blobs.
+// blobUrl has to carry a SAS token with read, write and create permissions. Pages only containing zeros
+// are skipped since new page blobs read as zeros anyway, which keeps uploads of sparse disk images short.
+func uploadPageBlob(ctx context.Context, httpClient *http.Client, blobUrl string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	size := info.Size()
+	if size%512 != 0 {
+		return fmt.Errorf("%s is no fixed size VHD, its size is not a multiple of 512 bytes", path)
+	}
+
+	uploaded, err := isUploaded(ctx, httpClient, blobUrl, size)
+	if err != nil || uploaded {
+		return err
+	}
+
+	err = blobRequest(ctx, httpClient, http.MethodPut, blobUrl, nil, map[string]string{
+		"x-ms-blob-type":           "PageBlob",
+		"x-ms-blob-content-length": strconv.FormatInt(size, 10),
+	}, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+
+	page := make([]byte, pageSize)
+	for offset := int64(0); offset < size; offset += pageSize {
+		n, err := io.ReadFull(file, page)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if isZero(page[:n]) {
+			continue
+		}
+		err = blobRequest(ctx, httpClient, http.MethodPut, blobUrl+"&comp=page", page[:n], map[string]string{
+			"x-ms-page-write": "update",
+			"x-ms-range":      fmt.Sprintf("bytes=%d-%d", offset, offset+int64(n)-1),
+		}, http.StatusCreated)
+		if err != nil {
+			return err
+		}
+	}
+
+	return blobRequest(ctx, httpClient, http.MethodPut, blobUrl+"&comp=metadata", nil, map[string]string{
+		uploadedMetadata: "true",
+	}, http.StatusOK)
+}
+
+// isUploaded reports whether a previous upload of a blob of the same size completed
+func isUploaded(ctx context.Context, httpClient *http.Client, blobUrl string, size int64) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, blobUrl, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("x-ms-version", blobApiVersion)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up blob: %w", withoutUrl(err))
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("failed to look up blob: %s", resp.Status)
+	}
+	return resp.ContentLength == size && resp.Header.Get(uploadedMetadata) == "true", nil
+}
+
+func blobRequest(ctx context.Context, httpClient *http.Client, method string, url string, body []byte, headers map[string]string, expectedStatus int) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("x-ms-version", blobApiVersion)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("blob request failed: %w", withoutUrl(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("blob request failed: %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutUrl strips the request URL from HTTP client errors, as it contains the SAS token
+func withoutUrl(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	return err
+}
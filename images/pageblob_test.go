@@ -0,0 +1,139 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"talos-azure/internal/testutil"
+	"testing"
+)
+
+// fakeBlob implements the page blob operations of the Blob service used by uploadPageBlob
+type fakeBlob struct {
+	mu       sync.Mutex
+	data     []byte
+	uploaded bool
+	pages    []string
+	requests int
+}
+
+func (b *fakeBlob) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests++
+	if r.URL.Query().Get("sig") != "secret" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodHead:
+		if b.data == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+		if b.uploaded {
+			w.Header().Set(uploadedMetadata, "true")
+		}
+	case r.URL.Query().Get("comp") == "page":
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("x-ms-range"), "bytes=%d-%d", &start, &end); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		copy(b.data[start:end+1], body)
+		b.pages = append(b.pages, r.Header.Get("x-ms-range"))
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Query().Get("comp") == "metadata":
+		b.uploaded = r.Header.Get(uploadedMetadata) == "true"
+	default:
+		if r.Header.Get("x-ms-blob-type") != "PageBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		size, _ := strconv.Atoi(r.Header.Get("x-ms-blob-content-length"))
+		b.data = make([]byte, size)
+		b.uploaded = false
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func TestUploadPageBlob(t *testing.T) {
+	// Three pages of which only the last one contains data, followed by a partial page
+	vhd := make([]byte, 3*pageSize+1024)
+	copy(vhd[2*pageSize:], "talos")
+	copy(vhd[3*pageSize:], "footer")
+	path := filepath.Join(t.TempDir(), "talos.vhd")
+	if err := os.WriteFile(path, vhd, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := &fakeBlob{}
+	server := httptest.NewServer(blob)
+	defer server.Close()
+	blobUrl := server.URL + "/images/talos.vhd?sig=secret"
+
+	err := uploadPageBlob(context.Background(), server.Client(), blobUrl, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPages := []string{
+		"bytes=" + strconv.Itoa(2*pageSize) + "-" + strconv.Itoa(3*pageSize-1),
+		"bytes=" + strconv.Itoa(3*pageSize) + "-" + strconv.Itoa(len(vhd)-1),
+	}
+	if len(blob.pages) != len(wantPages) || blob.pages[0] != wantPages[0] || blob.pages[1] != wantPages[1] {
+		t.Errorf("uploaded pages %v, want %v", blob.pages, wantPages)
+	}
+	if !bytes.Equal(blob.data, vhd) || !blob.uploaded {
+		t.Fatalf("blob doesn't match the VHD after the upload")
+	}
+
+	// A completed upload is only looked up
+	blob.requests = 0
+	err = uploadPageBlob(context.Background(), server.Client(), blobUrl, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.requests != 1 {
+		t.Errorf("second upload sent %d requests, want 1", blob.requests)
+	}
+
+	// An interrupted upload is retried
+	blob.uploaded = false
+	blob.pages = nil
+	err = uploadPageBlob(context.Background(), server.Client(), blobUrl, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blob.pages) != len(wantPages) || !blob.uploaded {
+		t.Errorf("interrupted upload wasn't retried, uploaded pages %v", blob.pages)
+	}
+}
+
+func TestUploadPageBlobErrors(t *testing.T) {
+	dir := t.TempDir()
+	unaligned := filepath.Join(dir, "unaligned.vhd")
+	if err := os.WriteFile(unaligned, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	aligned := filepath.Join(dir, "talos.vhd")
+	if err := os.WriteFile(aligned, make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(&fakeBlob{})
+	defer server.Close()
+
+	testutil.CheckErr(t, uploadPageBlob(context.Background(), server.Client(), server.URL+"/images/talos.vhd?sig=secret", unaligned), "is no fixed size VHD")
+	testutil.CheckErr(t, uploadPageBlob(context.Background(), server.Client(), server.URL+"/images/talos.vhd?sig=secret", filepath.Join(dir, "missing.vhd")), "failed to open")
+	testutil.CheckErr(t, uploadPageBlob(context.Background(), server.Client(), server.URL+"/images/talos.vhd?sig=wrong", aligned), "failed to look up blob: 403 Forbidden")
+}
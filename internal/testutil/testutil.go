@@ -0,0 +1,72 @@
+// Package testutil holds helpers shared by the tests of the other packages
+package testutil
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// CheckErr fails the test unless err contains wantErr, or unless err is nil when wantErr is empty
+func CheckErr(t *testing.T, err error, wantErr string) {
+	t.Helper()
+	if wantErr == "" {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+	if err == nil {
+		t.Fatalf("expected an error containing %q", wantErr)
+	}
+	if !strings.Contains(err.Error(), wantErr) {
+		t.Fatalf("error %q does not contain %q", err, wantErr)
+	}
+}
+
+// Mocks creates resources with their inputs as outputs and answers invokes with their arguments
+type Mocks struct{}
+
+func (Mocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	return args.Name + "-id", args.Inputs, nil
+}
+
+func (Mocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	return args.Args, nil
+}
+
+// WithConfig runs fn within a mocked Pulumi program, values are keyed by namespace:key like stack config
+func WithConfig(t *testing.T, values map[string]string, fn func(ctx *pulumi.Context) error) {
+	t.Helper()
+	WithMocks(t, values, Mocks{}, fn)
+}
+
+// WithMocks is WithConfig with other mocks, e.g. ones recording the registered resources
+func WithMocks(t *testing.T, values map[string]string, mocks pulumi.MockResourceMonitor, fn func(ctx *pulumi.Context) error) {
+	t.Helper()
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PULUMI_CONFIG", string(encoded))
+	err = pulumi.RunErr(fn, pulumi.WithMocks("talos-azure", "test", mocks))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// RequiredConfig returns the stack config helpers.GetConfig needs at least, tests add the keys they cover
+func RequiredConfig() map[string]string {
+	return map[string]string{
+		"azure-native:location":            "westeurope",
+		"azure-native:resource-group-name": "talos",
+		"cluster:name":                     "talos",
+		"cluster:architecture":             "x64",
+		"cluster:controls":                 "3",
+		"cluster:workers":                  "2",
+		"cluster:vm":                       "Standard_B2s",
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"talos-azure/artifacts"
+	"talos-azure/cloudprovider"
 	"talos-azure/cluster"
 	"talos-azure/helpers"
+	"talos-azure/identity"
+	"talos-azure/images"
 	"talos-azure/network"
+	"talos-azure/versions"
 
 	"github.com/pulumi/pulumi-azure-native-sdk/resources/v2"
 	"github.com/pulumi/pulumi-azure-native-sdk/storage/v2"
@@ -14,6 +18,15 @@ import (
 
 func main() {
 	pulumi.Run(func(ctx *pulumi.Context) error {
+		// cluster:talos-version may be a constraint, everything depending on the version gets the resolved one
+		talosVersion, err := versions.ResolveTalosVersion(ctx)
+		if err != nil {
+			return err
+		}
+		kubernetesVersion, err := versions.ResolveKubernetesVersion(ctx, talosVersion)
+		if err != nil {
+			return err
+		}
 		conf, err := helpers.GetConfig(ctx)
 		if err != nil {
 			return err
@@ -61,37 +74,190 @@ func main() {
 			return err
 		}
 
-		clusterSecrets, err := cluster.GetMachineSecrets(ctx, conf.ClusterName, networkResources.PublicLbIp.IpAddress)
+		clusterSecrets, err := cluster.GetMachineSecrets(ctx, conf.ClusterName, networkResources.ApiIp)
 		if err != nil {
 			return err
 		}
 
 		commonTalosProps := cluster.CommonProps{
-			ClusterName: conf.ClusterName,
-			PublicIp:    networkResources.PublicLbIp.IpAddress,
-			Secrets:     clusterSecrets,
+			ClusterName:    conf.ClusterName,
+			ApiIp:          networkResources.ApiIp,
+			ApiIpV6:        networkResources.ApiIpV6,
+			Secrets:        clusterSecrets,
+			TalosEndpoints: networkResources.ControlPlaneEndpoints,
+			TalosVersion:   talosVersion.Deployed(),
+			// Kubernetes upgrades are rolled out by UpgradeKubernetes, not by the applied machine configs
+			KubernetesVersion: kubernetesVersion.Deployed(),
 		}
 		clusterClientCfg := cluster.GetClusterClientCfg(ctx, commonTalosProps)
 
-		machineCfg := cluster.GetMachineConfiguration(ctx, commonTalosProps)
+		schematic, err := images.ResolveSchematic(ctx, talosVersion.Version)
+		if err != nil {
+			return err
+		}
+		if schematic != nil {
+			commonTalosProps.InstallerImage = schematic.InstallerImage
+			ctx.Export("schematicId", pulumi.String(schematic.Id))
+		}
+		vhd, err := images.ResolveVhd(ctx, schematic, talosVersion.Version)
+		if err != nil {
+			return err
+		}
+		var imageId pulumi.StringInput
+		if vhd.Path != "" {
+			image, err := images.ProvisionImage(ctx, images.ProvisionImageParams{
+				ResourceGroup:  resourceGroup,
+				StorageAccount: storageAcc,
+				Vhd:            vhd,
+				TalosVersion:   talosVersion.Version,
+			})
+			if err != nil {
+				return err
+			}
+			imageId = image.Id
+			ctx.Export("imageId", image.Id)
+		}
 
-		controlNicIds := make([]pulumi.IDOutput, len(networkResources.ControlNetworkInterfaces))
-		for i, nic := range networkResources.ControlNetworkInterfaces {
-			controlNicIds[i] = nic.ID()
+		var identityId pulumi.StringInput
+		var cloudProviderIdentity cloudprovider.Identity
+		if conf.CloudProvider {
+			cloudProviderIdentity, err = cloudprovider.ProvisionIdentity(ctx, cloudprovider.ProvisionIdentityParams{
+				ResourceGroup: resourceGroup,
+			})
+			if err != nil {
+				return err
+			}
+			commonTalosProps.CloudProviderPatch, err = cloudprovider.ConfigPatch(ctx, cloudprovider.ConfigPatchParams{
+				ResourceGroup: resourceGroup,
+				Identity:      cloudProviderIdentity,
+				VnetName:      networkResources.VnetName,
+				NsgName:       networkResources.NetworkSecurityGroup.Name,
+				SubnetId:      networkResources.SubnetIds[helpers.RoleWorker][0],
+			})
+			if err != nil {
+				return err
+			}
+			identityId = cloudProviderIdentity.Id
+		}
+
+		poolIdentities, err := identity.ProvisionPoolIdentities(ctx, identity.ProvisionPoolIdentitiesParams{
+			ResourceGroup: resourceGroup,
+		})
+		if err != nil {
+			return err
+		}
+		poolIdentityIds := make(map[string]pulumi.StringInput, len(poolIdentities))
+		for pool, userAssigned := range poolIdentities {
+			poolIdentityIds[pool] = userAssigned.Id
+		}
+
+		machineCfg, err := cluster.GetMachineConfiguration(ctx, commonTalosProps)
+		if err != nil {
+			return err
+		}
+
+		nicIds := make(map[string][]pulumi.IDOutput, len(networkResources.NodePoolInterfaces))
+		for pool, nics := range networkResources.NodePoolInterfaces {
+			nicIds[pool] = make([]pulumi.IDOutput, len(nics))
+			for i, nic := range nics {
+				nicIds[pool][i] = nic.ID()
+			}
+		}
+		computeResources, err := cluster.ProvisionCompute(ctx, cluster.ProvisionComputeParams{
+			ResourceGroup:     resourceGroup,
+			MachineConfigs:    machineCfg,
+			NicIds:            nicIds,
+			StorageAccUri:     storageAcc.PrimaryEndpoints.Blob(),
+			WorkerSubnetIds:   networkResources.SubnetIds[helpers.RoleWorker],
+			OutboundPoolIdsV6: networkResources.OutboundPoolIdsV6,
+			NsgId:             networkResources.NetworkSecurityGroup.ID(),
+			IdentityId:        identityId,
+			PoolIdentityIds:   poolIdentityIds,
+			ImageId:           imageId,
+			TalosVersion:      talosVersion.Version,
+		})
+		if err != nil {
+			return err
 		}
 
-		workerNicIds := make([]pulumi.IDOutput, len(networkResources.WorkerNetworkInterfaces))
-		for i, nic := range networkResources.WorkerNetworkInterfaces {
-			workerNicIds[i] = nic.ID()
+		poolPrincipalIds, err := identity.AssignSystemRoles(ctx, identity.AssignSystemRolesParams{
+			ResourceGroup: resourceGroup,
+			PoolNodes:     computeResources.PoolNodes,
+			PoolScaleSets: computeResources.PoolScaleSets,
+		})
+		if err != nil {
+			return err
+		}
+
+		bootstrapNodeIp := networkResources.ControlPlaneEndpoints[0].Elem()
+		bootstrap, err := cluster.Bootstrap(ctx, commonTalosProps, bootstrapNodeIp, computeResources, networkResources.DnsRecords)
+		if err != nil {
+			return err
+		}
+		kubeconfig := cluster.GetKubeconfig(ctx, commonTalosProps, bootstrap)
+
+		healthCheckNodes := make([]cluster.HealthCheckNode, 0)
+		scaleSetPools := make([]cluster.ScaleSetPool, 0)
+		for _, pool := range conf.NodePools {
+			if pool.ScaleSet {
+				scaleSetPools = append(scaleSetPools, cluster.ScaleSetPool{Name: pool.Name, Spot: pool.Spot})
+			}
+			for i, nic := range networkResources.NodePoolInterfaces[pool.Name] {
+				node := cluster.HealthCheckNode{
+					Name:         pool.NodeName(i),
+					PrivateIp:    nic.IpConfigurations.Index(pulumi.Int(0)).PrivateIPAddress(),
+					Controlplane: pool.IsControlplane(),
+				}
+				// Spot VMs with the Delete eviction policy are gone after an eviction, there is no power state to look up
+				if pool.Spot && pool.EvictionPolicy == helpers.EvictionPolicyDeallocate {
+					node.Evicted = cluster.VmEvicted(ctx, resourceGroup.Name, computeResources.PoolNodes[pool.Name][i])
+				}
+				healthCheckNodes = append(healthCheckNodes, node)
+			}
+		}
+		nodeIps := make(map[string][]pulumi.StringPtrOutput, len(networkResources.NodePoolInterfaces))
+		for pool, nics := range networkResources.NodePoolInterfaces {
+			for _, nic := range nics {
+				nodeIps[pool] = append(nodeIps[pool], nic.IpConfigurations.Index(pulumi.Int(0)).PrivateIPAddress())
+			}
 		}
-		_, err = cluster.ProvisionCompute(ctx, cluster.ProvisionComputeParams{
-			ResourceGroup:  resourceGroup,
+		configsApplied, err := cluster.ApplyMachineConfigs(ctx, commonTalosProps, cluster.ApplyMachineConfigsParams{
 			MachineConfigs: machineCfg,
-			WorkerNicIds:   workerNicIds,
-			ControlNicIds:  controlNicIds,
-			StorageAccUri:  storageAcc.PrimaryEndpoints.Blob(),
-			SubnetID:       networkResources.Vnet.Subnets.Index(pulumi.Int(0)).Id(),
-			NsgId:          networkResources.NetworkSecurityGroup.ID(),
+			NodeIps:        nodeIps,
+			Nodes:          computeResources.PoolNodes,
+			Bootstrap:      bootstrap,
+		})
+		if err != nil {
+			return err
+		}
+		clusterHealth := cluster.WaitForHealthy(ctx, cluster.WaitForHealthyParams{
+			ClientCfg:     clusterClientCfg,
+			Endpoints:     networkResources.ControlPlaneEndpoints,
+			Nodes:         healthCheckNodes,
+			ScaleSetPools: scaleSetPools,
+			Timeout:       conf.HealthTimeout,
+			ReadyAfter:    bootstrap.ID().ToStringOutput(),
+		})
+		talosUpgrade, err := cluster.UpgradeTalos(ctx, cluster.UpgradeTalosParams{
+			ClientCfg:      clusterClientCfg,
+			Nodes:          healthCheckNodes,
+			ScaleSetPools:  scaleSetPools,
+			Version:        talosVersion.Version,
+			InstallerImage: commonTalosProps.InstallerImage,
+			// Upgrades start from the current machine configs, e.g. with the installer image of cluster:schematic
+			ReadyAfter: pulumi.All(clusterHealth, configsApplied),
+		})
+		if err != nil {
+			return err
+		}
+		// Kubernetes versions depend on the Talos version, so Talos is upgraded first
+		kubernetesUpgrade, err := cluster.UpgradeKubernetes(ctx, cluster.UpgradeKubernetesParams{
+			ClientCfg:     clusterClientCfg,
+			Nodes:         healthCheckNodes,
+			ScaleSetPools: scaleSetPools,
+			Version:       kubernetesVersion.Upgrade(),
+			Kubeconfig:    kubeconfig,
+			ReadyAfter:    pulumi.All(talosUpgrade, configsApplied),
 		})
 		if err != nil {
 			return err
@@ -99,7 +265,7 @@ func main() {
 
 		nicOutputs := make([]interface{}, len(networkResources.ControlNetworkInterfaces))
 		for i, nic := range networkResources.ControlNetworkInterfaces {
-			nicIp := networkResources.NetworkInterfacePublicIPs[i].IpAddress
+			nicIp := networkResources.ControlPlaneEndpoints[i]
 			nicOutput := pulumi.All(nic.Name, nicIp).ApplyT(
 				func(args []interface{}) map[string]interface{} {
 					name := args[0].(string)
@@ -117,23 +283,54 @@ func main() {
 				return args
 			}).(pulumi.ArrayOutput)
 
-		clusterClientCfg.TalosConfig().ApplyT(func(cfg string) (string, error) {
-			d1 := []byte(cfg)
-			err := os.WriteFile("secrets/talosconfig", d1, 0644)
-			if err != nil {
-				return "", err
-			}
-
-			return "ok", nil
-		})
+		artifactWriter := artifacts.NewWriter(ctx, conf.ArtifactsDir)
+		artifactWriter.Write("talosconfig", clusterClientCfg.TalosConfig())
+		if conf.WriteKubeconfig {
+			artifactWriter.Write("kubeconfig", kubeconfig)
+		}
 
 		ctx.Export("NetworkInterfaces", nicOut)
-		ctx.Export("Vnet.Name", networkResources.Vnet.Name)
-		ctx.Export("PublicIp.IpAddress", networkResources.PublicLbIp.IpAddress)
-		ctx.Export("PublicNatIp.IpAddress", networkResources.PublicNatIp.IpAddress)
-		ctx.Export("LoadBalancer.IpAddress", networkResources.PublicLbIp.IpAddress)
+		ctx.Export("Vnet.Name", networkResources.VnetName)
+		if networkResources.PublicLbIp != nil {
+			ctx.Export("PublicIp.IpAddress", networkResources.PublicLbIp.IpAddress)
+		}
+		natIps := make(pulumi.StringArray, len(networkResources.PublicNatIps))
+		for i, ip := range networkResources.PublicNatIps {
+			natIps[i] = ip.IpAddress.Elem()
+		}
+		ctx.Export("PublicNatIps", natIps)
+		// Kept for consumers of the output from before NAT gateways were created per zone
+		if len(natIps) > 0 {
+			ctx.Export("PublicNatIp.IpAddress", natIps[0])
+		}
+		ctx.Export("LoadBalancer.IpAddress", networkResources.ApiIp)
+		if conf.EndpointDomain != "" {
+			ctx.Export("clusterEndpoint", pulumi.Sprintf("https://%s:6443", conf.EndpointDomain))
+		}
+		nodeIdentities := pulumi.Map{}
+		for pool, userAssigned := range poolIdentities {
+			nodeIdentities[pool] = pulumi.Map{
+				"type":     pulumi.String(helpers.IdentityTypeUserAssigned),
+				"clientId": userAssigned.ClientId,
+			}
+		}
+		for pool, principalIds := range poolPrincipalIds {
+			nodeIdentities[pool] = pulumi.Map{
+				"type":         pulumi.String(helpers.IdentityTypeSystemAssigned),
+				"principalIds": principalIds,
+			}
+		}
+		ctx.Export("nodeIdentities", nodeIdentities)
+		if conf.CloudProvider {
+			ctx.Export("cloudProviderIdentity.ClientId", cloudProviderIdentity.ClientId)
+		}
 		ctx.Export("clusterClientCfg", clusterClientCfg.TalosConfig())
 		ctx.Export("storageAccount.Name", storageAcc.Name)
+		ctx.Export("kubeconfig", kubeconfig)
+		ctx.Export("clusterHealth", clusterHealth)
+		ctx.Export("talosUpgrade", talosUpgrade)
+		ctx.Export("kubernetesUpgrade", kubernetesUpgrade)
+		ctx.Export("artifacts", artifactWriter.Paths())
 
 		return nil
 	})
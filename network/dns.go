@@ -0,0 +1,46 @@
+package network
+
+import (
+	"talos-azure/helpers"
+
+	"github.com/pulumi/pulumi-azure-native-sdk/network/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const dnsRecordTtl = 300
+
+// provisionDnsRecords points the endpoint domain at the load balancer frontends, with an AAAA record next to
+// the A record for dual-stack clusters. The record sets are created within the existing zone.
+func provisionDnsRecords(ctx *pulumi.Context, conf helpers.CustomConfig, lbRes lbResources) ([]*network.RecordSet, error) {
+	if conf.DnsZone == nil {
+		return nil, nil
+	}
+
+	recordTypes := []string{"A"}
+	if conf.AddressSpace.DualStack {
+		recordTypes = append(recordTypes, "AAAA")
+	}
+
+	recordSets := make([]*network.RecordSet, 0, len(recordTypes))
+	for _, recordType := range recordTypes {
+		args := &network.RecordSetArgs{
+			ResourceGroupName:     pulumi.String(conf.DnsZone.ResourceGroupName),
+			ZoneName:              pulumi.String(conf.DnsZone.ZoneName),
+			RelativeRecordSetName: pulumi.String(conf.DnsZone.RecordName(conf.EndpointDomain)),
+			RecordType:            pulumi.String(recordType),
+			Ttl:                   pulumi.Float64(dnsRecordTtl),
+		}
+		if recordType == "A" {
+			args.ARecords = network.ARecordArray{network.ARecordArgs{Ipv4Address: lbRes.apiIp}}
+		} else {
+			args.AaaaRecords = network.AaaaRecordArray{network.AaaaRecordArgs{Ipv6Address: lbRes.apiIpV6}}
+		}
+		recordSet, err := network.NewRecordSet(ctx, "api-dns-"+recordType, args)
+		if err != nil {
+			return nil, err
+		}
+		recordSets = append(recordSets, recordSet)
+	}
+
+	return recordSets, nil
+}
@@ -1,6 +1,9 @@
 package network
 
 import (
+	"strings"
+	"talos-azure/helpers"
+
 	"github.com/pulumi/pulumi-azure-native-sdk/network/v2"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
@@ -8,21 +11,125 @@ import (
 type securityRuleParams struct {
 	name                 string
 	DestinationPortRange string
+	Sources              []string
+	// SourceIps are added to Sources, for addresses only known once resources exist
+	SourceIps    pulumi.StringArray
+	Destinations []string
+	// Direction, Access and Protocol default to Inbound, Allow and TCP
+	Direction string
+	Access    string
+	Protocol  string
+	Priority  int
+}
+
+// makeSecurityRule builds a standalone rule, the resource group and network security group are set by the caller
+func makeSecurityRule(params securityRuleParams) network.SecurityRuleArgs {
+	rule := network.SecurityRuleArgs{
+		SecurityRuleName:     pulumi.String(params.name),
+		DestinationPortRange: pulumi.String(params.DestinationPortRange),
+		Direction:            pulumi.String(orDefault(params.Direction, "inbound")),
+		Protocol:             pulumi.String(orDefault(params.Protocol, "TCP")),
+		Access:               pulumi.String(orDefault(params.Access, "Allow")),
+		SourcePortRange:      pulumi.String("*"),
+		Priority:             pulumi.Int(params.Priority),
+	}
+	// Service tags and wildcards are only accepted as a single prefix, not within a list
+	if len(params.Sources) == 1 && len(params.SourceIps) == 0 {
+		rule.SourceAddressPrefix = pulumi.String(params.Sources[0])
+	} else {
+		rule.SourceAddressPrefixes = append(pulumi.ToStringArray(params.Sources), params.SourceIps...)
+	}
+	if len(params.Destinations) == 0 {
+		rule.DestinationAddressPrefix = pulumi.String("*")
+	} else if len(params.Destinations) == 1 {
+		rule.DestinationAddressPrefix = pulumi.String(params.Destinations[0])
+	} else {
+		rule.DestinationAddressPrefixes = pulumi.ToStringArray(params.Destinations)
+	}
+	return rule
+}
+
+// makeSecurityRules lists the built-in rules followed by the user defined ones. Built-in rules get
+// fixed priorities, so adding or removing rules never shifts the priority of others.
+func makeSecurityRules(conf helpers.CustomConfig, subnetPrefixes []string, natIps []*network.PublicIPAddress) []securityRuleParams {
+	// IPv4 and IPv6 prefixes can't be mixed within one rule
+	var subnetPrefixesV4, subnetPrefixesV6 []string
+	for _, prefix := range subnetPrefixes {
+		if strings.Contains(prefix, ":") {
+			subnetPrefixesV6 = append(subnetPrefixesV6, prefix)
+		} else {
+			subnetPrefixesV4 = append(subnetPrefixesV4, prefix)
+		}
+	}
+
+	rules := []securityRuleParams{
+		{name: "apid", DestinationPortRange: "50000", Sources: conf.AllowedSources.Talos, Priority: helpers.BuiltinRulePriorityBase + 1},
+		{name: "trustd", DestinationPortRange: "50001", Sources: subnetPrefixesV4, Priority: helpers.BuiltinRulePriorityBase + 2},
+		{name: "etcd", DestinationPortRange: "2379-2380", Sources: subnetPrefixesV4, Priority: helpers.BuiltinRulePriorityBase + 3},
+		{name: "kube", DestinationPortRange: "6443", Sources: conf.AllowedSources.Kubernetes, Priority: helpers.BuiltinRulePriorityBase + 4},
+	}
+	if len(subnetPrefixesV6) > 0 {
+		rules = append(rules,
+			securityRuleParams{name: "trustd-v6", DestinationPortRange: "50001", Sources: subnetPrefixesV6, Priority: helpers.BuiltinRulePriorityBase + 5},
+			securityRuleParams{name: "etcd-v6", DestinationPortRange: "2379-2380", Sources: subnetPrefixesV6, Priority: helpers.BuiltinRulePriorityBase + 6},
+		)
+	}
+	// Nodes reach the load balancer frontend from their subnets, or from the NAT gateway IPs when the frontend is
+	// public, so restricted API sources would lock out joining nodes and in-cluster API clients
+	nodeIps := pulumi.StringArray{}
+	for _, natIp := range natIps {
+		nodeIps = append(nodeIps, natIp.IpAddress.Elem())
+	}
+	if !allowsAll(conf.AllowedSources.Talos) {
+		rules = append(rules, securityRuleParams{name: "apid-nodes", DestinationPortRange: "50000", Sources: subnetPrefixesV4, SourceIps: nodeIps, Priority: helpers.BuiltinRulePriorityBase + 7})
+	}
+	if !allowsAll(conf.AllowedSources.Kubernetes) {
+		rules = append(rules, securityRuleParams{name: "kube-nodes", DestinationPortRange: "6443", Sources: subnetPrefixesV4, SourceIps: nodeIps, Priority: helpers.BuiltinRulePriorityBase + 8})
+	}
+	for _, rule := range conf.ExtraSecurityRules {
+		rules = append(rules, securityRuleParams{
+			name:                 rule.Name,
+			DestinationPortRange: rule.Ports,
+			Sources:              rule.Sources,
+			Destinations:         rule.Destinations,
+			Direction:            rule.Direction,
+			Access:               rule.Access,
+			Protocol:             rule.Protocol,
+			Priority:             rule.Priority,
+		})
+	}
+	return rules
+}
+
+// allowsAll reports whether the sources already include every node, nothing has to be added for those
+func allowsAll(sources []string) bool {
+	return len(sources) == 1 && (sources[0] == "*" || sources[0] == "Internet")
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// newPublicIp creates a static Standard public IP, zonal or zone redundant depending on the given zones
+func newPublicIp(ctx *pulumi.Context, name string, params ProvisionNetworkingParams, zones []string, version network.IPVersion) (*network.PublicIPAddress, error) {
+	return network.NewPublicIPAddress(ctx, name, &network.PublicIPAddressArgs{
+		PublicIPAllocationMethod: pulumi.String("static"),
+		PublicIPAddressVersion:   pulumi.String(version),
+		ResourceGroupName:        params.ResourceGroup.Name,
+		Sku: network.PublicIPAddressSkuArgs{
+			Name: pulumi.String(network.PublicIPAddressSkuNameStandard),
+		},
+		Zones: zonesInput(zones),
+	})
 }
 
-var rulePrio = 1000
-
-func makeSecurityRule(params securityRuleParams) network.SecurityRuleTypeArgs {
-	rulePrio++
-	return network.SecurityRuleTypeArgs{
-		Name:                     pulumi.String(params.name),
-		DestinationPortRange:     pulumi.String(params.DestinationPortRange),
-		Direction:                pulumi.String("inbound"),
-		Protocol:                 pulumi.String("TCP"),
-		Access:                   pulumi.String("Allow"),
-		SourcePortRange:          pulumi.String("*"),
-		SourceAddressPrefix:      pulumi.String("*"),
-		DestinationAddressPrefix: pulumi.String("*"),
-		Priority:                 pulumi.IntPtr(rulePrio),
+// zonesInput leaves zones unset rather than empty for non zonal resources, changing zones forces a replacement
+func zonesInput(zones []string) pulumi.StringArrayInput {
+	if len(zones) == 0 {
+		return nil
 	}
+	return pulumi.ToStringArray(zones)
 }
@@ -0,0 +1,131 @@
+package network
+
+import (
+	"talos-azure/helpers"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+func TestMakeSecurityRules(t *testing.T) {
+	open := helpers.AllowedSources{Talos: []string{"*"}, Kubernetes: []string{"*"}}
+	restricted := helpers.AllowedSources{Talos: []string{"203.0.113.0/24"}, Kubernetes: []string{"203.0.113.0/24"}}
+	web := helpers.SecurityRule{Name: "web", Direction: "Inbound", Access: "Allow", Protocol: "Tcp", Ports: "443", Sources: []string{"*"}, Priority: 2000}
+	dns := helpers.SecurityRule{Name: "dns", Direction: "Inbound", Access: "Allow", Protocol: "Udp", Ports: "53", Sources: []string{"*"}, Priority: 2010}
+
+	tests := []struct {
+		name     string
+		sources  helpers.AllowedSources
+		prefixes []string
+		extra    []helpers.SecurityRule
+		want     map[string]int
+	}{
+		{
+			"open",
+			open,
+			[]string{"10.0.0.0/24"},
+			nil,
+			map[string]int{"apid": 1001, "trustd": 1002, "etcd": 1003, "kube": 1004},
+		},
+		{
+			"dual-stack",
+			open,
+			[]string{"10.0.0.0/24", "fd00::/64"},
+			nil,
+			map[string]int{"apid": 1001, "trustd": 1002, "etcd": 1003, "kube": 1004, "trustd-v6": 1005, "etcd-v6": 1006},
+		},
+		{
+			"restricted",
+			restricted,
+			[]string{"10.0.0.0/24"},
+			nil,
+			map[string]int{"apid": 1001, "trustd": 1002, "etcd": 1003, "kube": 1004, "apid-nodes": 1007, "kube-nodes": 1008},
+		},
+		{
+			"extra rules",
+			open,
+			[]string{"10.0.0.0/24"},
+			[]helpers.SecurityRule{web, dns},
+			map[string]int{"apid": 1001, "trustd": 1002, "etcd": 1003, "kube": 1004, "web": 2000, "dns": 2010},
+		},
+		{
+			"removed extra rule",
+			open,
+			[]string{"10.0.0.0/24"},
+			[]helpers.SecurityRule{dns},
+			map[string]int{"apid": 1001, "trustd": 1002, "etcd": 1003, "kube": 1004, "dns": 2010},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := helpers.CustomConfig{AllowedSources: tt.sources, ExtraSecurityRules: tt.extra}
+			rules := makeSecurityRules(conf, tt.prefixes, nil)
+			got := make(map[string]int, len(rules))
+			for _, rule := range rules {
+				if _, ok := got[rule.name]; ok {
+					t.Fatalf("rule %s is created more than once", rule.name)
+				}
+				got[rule.name] = rule.Priority
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("makeSecurityRules() = %v, want %v", got, tt.want)
+			}
+			for name, priority := range tt.want {
+				if got[name] != priority {
+					t.Errorf("priority of %s = %d, want %d", name, got[name], priority)
+				}
+			}
+		})
+	}
+}
+
+func TestMakeSecurityRulesSplitsAddressFamilies(t *testing.T) {
+	conf := helpers.CustomConfig{AllowedSources: helpers.AllowedSources{Talos: []string{"*"}, Kubernetes: []string{"*"}}}
+	for _, rule := range makeSecurityRules(conf, []string{"10.0.0.0/24", "10.0.1.0/24", "fd00::/64"}, nil) {
+		switch rule.name {
+		case "etcd":
+			if len(rule.Sources) != 2 || rule.Sources[0] != "10.0.0.0/24" || rule.Sources[1] != "10.0.1.0/24" {
+				t.Errorf("etcd sources = %v, want the IPv4 subnets", rule.Sources)
+			}
+		case "etcd-v6":
+			if len(rule.Sources) != 1 || rule.Sources[0] != "fd00::/64" {
+				t.Errorf("etcd-v6 sources = %v, want the IPv6 subnet", rule.Sources)
+			}
+		}
+	}
+}
+
+func TestMakeSecurityRule(t *testing.T) {
+	single := makeSecurityRule(securityRuleParams{name: "kube", DestinationPortRange: "6443", Sources: []string{"Internet"}, Priority: 1004})
+	if single.SourceAddressPrefix != pulumi.String("Internet") || single.SourceAddressPrefixes != nil {
+		t.Errorf("a single source should be set as prefix, got %v and %v", single.SourceAddressPrefix, single.SourceAddressPrefixes)
+	}
+	if single.DestinationAddressPrefix != pulumi.String("*") {
+		t.Errorf("destination = %v, want *", single.DestinationAddressPrefix)
+	}
+	if single.Direction != pulumi.String("inbound") || single.Protocol != pulumi.String("TCP") || single.Access != pulumi.String("Allow") {
+		t.Errorf("defaults = %v %v %v, want inbound TCP Allow", single.Direction, single.Protocol, single.Access)
+	}
+
+	multiple := makeSecurityRule(securityRuleParams{
+		name:                 "smtp",
+		DestinationPortRange: "25",
+		Sources:              []string{"10.0.0.0/24", "10.0.1.0/24"},
+		Destinations:         []string{"198.51.100.1", "198.51.100.2"},
+		Direction:            "Outbound",
+		Access:               "Deny",
+		Protocol:             "*",
+		Priority:             2000,
+	})
+	sources, ok := multiple.SourceAddressPrefixes.(pulumi.StringArray)
+	if !ok || len(sources) != 2 || multiple.SourceAddressPrefix != nil {
+		t.Errorf("multiple sources should be set as prefixes, got %v and %v", multiple.SourceAddressPrefix, multiple.SourceAddressPrefixes)
+	}
+	destinations, ok := multiple.DestinationAddressPrefixes.(pulumi.StringArray)
+	if !ok || len(destinations) != 2 || multiple.DestinationAddressPrefix != nil {
+		t.Errorf("multiple destinations should be set as prefixes, got %v and %v", multiple.DestinationAddressPrefix, multiple.DestinationAddressPrefixes)
+	}
+	if multiple.Direction != pulumi.String("Outbound") || multiple.Access != pulumi.String("Deny") || multiple.Protocol != pulumi.String("*") {
+		t.Errorf("explicit values = %v %v %v, want Outbound Deny *", multiple.Direction, multiple.Access, multiple.Protocol)
+	}
+}
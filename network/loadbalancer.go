@@ -0,0 +1,255 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+	"talos-azure/helpers"
+
+	"github.com/pulumi/pulumi-azure-native-sdk/network/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// defaultLbName is the name of load balancers of new stacks
+const defaultLbName = "lb"
+
+type lbResources struct {
+	lb *network.LoadBalancer
+	// publicLbIp is nil for private clusters
+	publicLbIp *network.PublicIPAddress
+	apiIp      pulumi.StringPtrOutput
+	// apiIpV6 is only set for dual-stack clusters
+	apiIpV6 pulumi.StringPtrOutput
+	// backendPoolIds holds the control plane backend pool of each IP family, IPv4 first
+	backendPoolIds []pulumi.StringPtrOutput
+	// outboundPoolIdsV6 holds the backend pool of the IPv6 outbound rule, empty unless the cluster is public and dual-stack
+	outboundPoolIdsV6 []pulumi.StringPtrOutput
+}
+
+// lbPort is a port balanced across the control plane nodes
+type lbPort struct {
+	name      string
+	port      int
+	probeName string
+	probe     network.ProbeArgs
+}
+
+// provisionLoadBalancer fronts the control plane nodes only. The Kubernetes API is health checked via /readyz,
+// so nodes which aren't ready don't receive any traffic.
+func provisionLoadBalancer(ctx *pulumi.Context, conf helpers.CustomConfig, params ProvisionNetworkingParams, vnetRes vnetResources) (lbResources, error) {
+	ports := []lbPort{{
+		name:      "kube-apiserver",
+		port:      6443,
+		probeName: "kube-apiserver-health",
+		probe: network.ProbeArgs{
+			Port:        pulumi.Int(6443),
+			Protocol:    pulumi.String(network.ProbeProtocolHttps),
+			RequestPath: pulumi.String("/readyz"),
+		},
+	}}
+	if conf.LoadBalanceApid {
+		ports = append(ports, lbPort{
+			name:      "apid",
+			port:      50000,
+			probeName: "apid-health",
+			probe: network.ProbeArgs{
+				Port:     pulumi.Int(50000),
+				Protocol: pulumi.String(network.ProbeProtocolTcp),
+			},
+		})
+	}
+
+	lbName := resolveLbName(ctx, conf, params)
+
+	versions := []network.IPVersion{network.IPVersionIPv4}
+	if conf.AddressSpace.DualStack {
+		versions = append(versions, network.IPVersionIPv6)
+	}
+
+	// Private clusters use an internal load balancer with a frontend IP in the control plane subnet
+	var publicLbIp *network.PublicIPAddress
+	var publicLbIpV6 pulumi.StringPtrOutput
+	frontends := network.FrontendIPConfigurationArray{}
+	backendPools := network.BackendAddressPoolArray{}
+	probes := network.ProbeArray{}
+	rules := network.LoadBalancingRuleArray{}
+	for _, port := range ports {
+		probe := port.probe
+		probe.Name = pulumi.String(port.probeName)
+		probes = append(probes, probe)
+	}
+	for _, version := range versions {
+		suffix := ""
+		if version == network.IPVersionIPv6 {
+			suffix = "-v6"
+		}
+		frontendName := "talos-fe" + suffix
+		backendPoolName := "talos-be-pool" + suffix
+
+		frontend := network.FrontendIPConfigurationArgs{
+			Name: pulumi.String(frontendName),
+		}
+		if conf.IsPrivate() {
+			frontend.Subnet = network.SubnetTypeArgs{Id: vnetRes.subnetIds[helpers.RoleControlplane][0]}
+			frontend.PrivateIPAllocationMethod = pulumi.String(network.IPAllocationMethodDynamic)
+			frontend.PrivateIPAddressVersion = pulumi.String(version)
+			frontend.Zones = zonesInput(conf.Zones)
+		} else {
+			// Zone redundant when zones are used
+			frontendIp, err := newPublicIp(ctx, "public-lb-ip"+suffix, params, conf.Zones, version)
+			if err != nil {
+				return lbResources{}, err
+			}
+			if version == network.IPVersionIPv4 {
+				publicLbIp = frontendIp
+			} else {
+				publicLbIpV6 = frontendIp.IpAddress
+			}
+			frontend.PublicIPAddress = network.PublicIPAddressTypeArgs{
+				IpAddress: frontendIp.IpAddress,
+				Id:        frontendIp.ID(),
+			}
+		}
+		frontends = append(frontends, frontend)
+		backendPools = append(backendPools, network.BackendAddressPoolArgs{
+			Name: pulumi.String(backendPoolName),
+		})
+
+		for _, port := range ports {
+			rules = append(rules, network.LoadBalancingRuleArgs{
+				Name:                    pulumi.String(port.name + suffix),
+				Protocol:                pulumi.String(network.TransportProtocolTcp),
+				FrontendPort:            pulumi.Int(port.port),
+				BackendPort:             pulumi.Int(port.port),
+				FrontendIPConfiguration: network.SubResourceArgs{Id: lbChildId(params, lbName, "frontendIPConfigurations", frontendName)},
+				BackendAddressPool:      network.SubResourceArgs{Id: lbChildId(params, lbName, "backendAddressPools", backendPoolName)},
+				Probe:                   network.SubResourceArgs{Id: lbChildId(params, lbName, "probes", port.probeName)},
+				EnableTcpReset:          pulumi.Bool(true),
+				// Outbound connectivity is provided by the NAT gateway or the existing network, not the load balancer
+				DisableOutboundSnat: pulumi.Bool(!conf.IsPrivate()),
+			})
+		}
+	}
+
+	// The NAT gateway only handles IPv4, every node egresses over IPv6 through an outbound rule instead. Internal
+	// load balancers can't provide outbound connectivity, private clusters have no IPv6 egress.
+	outboundRules := network.OutboundRuleArray{}
+	hasOutboundV6 := conf.AddressSpace.DualStack && !conf.IsPrivate()
+	if hasOutboundV6 {
+		outboundIp, err := newPublicIp(ctx, "public-outbound-ip-v6", params, conf.Zones, network.IPVersionIPv6)
+		if err != nil {
+			return lbResources{}, err
+		}
+		frontends = append(frontends, network.FrontendIPConfigurationArgs{
+			Name: pulumi.String("outbound-fe-v6"),
+			PublicIPAddress: network.PublicIPAddressTypeArgs{
+				Id: outboundIp.ID(),
+			},
+		})
+		backendPools = append(backendPools, network.BackendAddressPoolArgs{
+			Name: pulumi.String("outbound-be-pool-v6"),
+		})
+		outboundRules = append(outboundRules, network.OutboundRuleArgs{
+			Name:     pulumi.String("outbound-v6"),
+			Protocol: pulumi.String(network.LoadBalancerOutboundRuleProtocolAll),
+			FrontendIPConfigurations: network.SubResourceArray{
+				network.SubResourceArgs{Id: lbChildId(params, lbName, "frontendIPConfigurations", "outbound-fe-v6")},
+			},
+			BackendAddressPool:   network.SubResourceArgs{Id: lbChildId(params, lbName, "backendAddressPools", "outbound-be-pool-v6")},
+			EnableTcpReset:       pulumi.Bool(true),
+			IdleTimeoutInMinutes: pulumi.Int(4),
+		})
+	}
+
+	lb, err := network.NewLoadBalancer(ctx, "lb", &network.LoadBalancerArgs{
+		// The name has to be known upfront, rules reference the frontends, backend pools and probes by id
+		LoadBalancerName:         lbName,
+		FrontendIPConfigurations: frontends,
+		Sku: network.LoadBalancerSkuArgs{
+			Name: pulumi.String(network.LoadBalancerSkuNameStandard),
+		},
+		BackendAddressPools: backendPools,
+		ResourceGroupName:   params.ResourceGroup.Name,
+		Probes:              probes,
+		LoadBalancingRules:  rules,
+		OutboundRules:       outboundRules,
+	})
+	if err != nil {
+		return lbResources{}, err
+	}
+
+	var apiIp, apiIpV6 pulumi.StringPtrOutput
+	if conf.IsPrivate() {
+		apiIp = lb.FrontendIPConfigurations.Index(pulumi.Int(0)).PrivateIPAddress()
+		if conf.AddressSpace.DualStack {
+			apiIpV6 = lb.FrontendIPConfigurations.Index(pulumi.Int(1)).PrivateIPAddress()
+		}
+	} else {
+		apiIp = publicLbIp.IpAddress
+		apiIpV6 = publicLbIpV6
+	}
+
+	backendPoolIds := make([]pulumi.StringPtrOutput, len(versions))
+	for i := range versions {
+		backendPoolIds[i] = lb.BackendAddressPools.Index(pulumi.Int(i)).Id()
+	}
+
+	var outboundPoolIdsV6 []pulumi.StringPtrOutput
+	if hasOutboundV6 {
+		outboundPoolIdsV6 = append(outboundPoolIdsV6, lb.BackendAddressPools.Index(pulumi.Int(len(versions))).Id())
+	}
+
+	return lbResources{lb, publicLbIp, apiIp, apiIpV6, backendPoolIds, outboundPoolIdsV6}, nil
+}
+
+// lbChildId builds the id of a frontend, backend pool or probe of the load balancer before it exists
+func lbChildId(params ProvisionNetworkingParams, lbName pulumi.StringOutput, kind string, name string) pulumi.StringOutput {
+	return pulumi.Sprintf("%s/providers/Microsoft.Network/loadBalancers/%s/%s/%s", params.ResourceGroup.ID(), lbName, kind, name)
+}
+
+// resolveLbName keeps the name of the load balancer the first control plane NIC is attached to. Stacks created
+// before the load balancer got a fixed name have an auto-named one, renaming it would replace it while its
+// frontend IPs can only be attached to one load balancer at a time.
+func resolveLbName(ctx *pulumi.Context, conf helpers.CustomConfig, params ProvisionNetworkingParams) pulumi.StringOutput {
+	var nicName string
+	for _, pool := range conf.NodePools {
+		if pool.IsControlplane() && !pool.ScaleSet {
+			nicName = fmt.Sprintf("%s-nic-0", pool.NetworkPrefix())
+			break
+		}
+	}
+	return params.ResourceGroup.Name.ApplyT(func(resourceGroupName string) (string, error) {
+		nic, err := network.LookupNetworkInterface(ctx, &network.LookupNetworkInterfaceArgs{
+			ResourceGroupName:    resourceGroupName,
+			NetworkInterfaceName: nicName,
+		})
+		if err != nil {
+			// New stacks have no NICs yet
+			if strings.Contains(err.Error(), "NotFound") {
+				return defaultLbName, nil
+			}
+			return "", fmt.Errorf("failed to look up the load balancer of NIC %s: %w", nicName, err)
+		}
+		for _, ipConfig := range nic.IpConfigurations {
+			for _, pool := range ipConfig.LoadBalancerBackendAddressPools {
+				if pool.Id == nil {
+					continue
+				}
+				if name := lbNameOf(*pool.Id); name != "" {
+					return name, nil
+				}
+			}
+		}
+		return defaultLbName, nil
+	}).(pulumi.StringOutput)
+}
+
+// lbNameOf returns the load balancer name of a backend pool id, or an empty string for other ids
+func lbNameOf(backendPoolId string) string {
+	parts := strings.Split(strings.Trim(backendPoolId, "/"), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "loadBalancers") {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
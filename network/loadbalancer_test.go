@@ -0,0 +1,105 @@
+package network
+
+import (
+	"slices"
+	"talos-azure/helpers"
+	"talos-azure/internal/testutil"
+	"testing"
+
+	"github.com/pulumi/pulumi-azure-native-sdk/network/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/resources/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+func TestProvisionLoadBalancer(t *testing.T) {
+	tests := []struct {
+		name            string
+		networkMode     string
+		dualStack       bool
+		loadBalanceApid bool
+		wantRules       []string
+		wantFrontends   []string
+		wantOutboundV6  bool
+		wantOutboundOff bool
+	}{
+		{"public", helpers.NetworkModePublic, false, false, []string{"kube-apiserver"}, []string{"talos-fe"}, false, true},
+		{"public apid", helpers.NetworkModePublic, false, true, []string{"kube-apiserver", "apid"}, []string{"talos-fe"}, false, true},
+		{
+			"public dual-stack", helpers.NetworkModePublic, true, false,
+			[]string{"kube-apiserver", "kube-apiserver-v6"}, []string{"talos-fe", "talos-fe-v6", "outbound-fe-v6"}, true, true,
+		},
+		{"private", helpers.NetworkModePrivate, false, true, []string{"kube-apiserver", "apid"}, []string{"talos-fe"}, false, false},
+		{
+			"private dual-stack", helpers.NetworkModePrivate, true, false,
+			[]string{"kube-apiserver", "kube-apiserver-v6"}, []string{"talos-fe", "talos-fe-v6"}, false, false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testutil.WithConfig(t, nil, func(ctx *pulumi.Context) error {
+				resourceGroup, err := resources.NewResourceGroup(ctx, "rg", nil)
+				if err != nil {
+					return err
+				}
+				conf := helpers.CustomConfig{
+					NetworkMode:     tt.networkMode,
+					LoadBalanceApid: tt.loadBalanceApid,
+					AddressSpace:    helpers.AddressSpace{DualStack: tt.dualStack},
+					NodePools:       []helpers.NodePool{{Name: "control", Role: helpers.RoleControlplane, Count: 1}},
+				}
+				vnetRes := vnetResources{subnetIds: map[string][]pulumi.StringPtrOutput{
+					helpers.RoleControlplane: {pulumi.StringPtr("subnet-id").ToStringPtrOutput()},
+				}}
+				res, err := provisionLoadBalancer(ctx, conf, ProvisionNetworkingParams{ResourceGroup: resourceGroup}, vnetRes)
+				if err != nil {
+					return err
+				}
+
+				if got := len(res.outboundPoolIdsV6) > 0; got != tt.wantOutboundV6 {
+					t.Errorf("IPv6 outbound pool = %v, want %v", got, tt.wantOutboundV6)
+				}
+				if got := res.publicLbIp != nil; got != (tt.networkMode == helpers.NetworkModePublic) {
+					t.Errorf("public IP = %v in %s mode", got, tt.networkMode)
+				}
+				pulumi.All(res.lb.LoadBalancingRules, res.lb.FrontendIPConfigurations).ApplyT(func(args []interface{}) error {
+					var ruleNames []string
+					for _, rule := range args[0].([]network.LoadBalancingRuleResponse) {
+						ruleNames = append(ruleNames, *rule.Name)
+						if rule.DisableOutboundSnat == nil || *rule.DisableOutboundSnat != tt.wantOutboundOff {
+							t.Errorf("rule %s disableOutboundSnat = %v, want %v", *rule.Name, rule.DisableOutboundSnat, tt.wantOutboundOff)
+						}
+					}
+					if !slices.Equal(ruleNames, tt.wantRules) {
+						t.Errorf("rules = %v, want %v", ruleNames, tt.wantRules)
+					}
+					var frontendNames []string
+					for _, frontend := range args[1].([]network.FrontendIPConfigurationResponse) {
+						frontendNames = append(frontendNames, *frontend.Name)
+					}
+					if !slices.Equal(frontendNames, tt.wantFrontends) {
+						t.Errorf("frontends = %v, want %v", frontendNames, tt.wantFrontends)
+					}
+					return nil
+				})
+				return nil
+			})
+		})
+	}
+}
+
+func TestLbNameOf(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/loadBalancers/lb1234/backendAddressPools/talos-be-pool", "lb1234"},
+		{"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/LOADBALANCERS/lb/backendAddressPools/pool", "lb"},
+		{"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/applicationGateways/gw/backendAddressPools/pool", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := lbNameOf(tt.id); got != tt.want {
+			t.Errorf("lbNameOf(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
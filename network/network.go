@@ -10,16 +10,38 @@ import (
 )
 
 type NetworkResources struct {
-	Vnet                      *network.VirtualNetwork
-	NetworkSecurityGroup      *network.NetworkSecurityGroup
-	PublicLbIp                *network.PublicIPAddress
-	PublicNatIp               *network.PublicIPAddress
-	LoadBalancer              *network.LoadBalancer
-	InboundNatRule            *network.InboundNatRule
-	ControlNetworkInterfaces  []*network.NetworkInterface
-	WorkerNetworkInterfaces   []*network.NetworkInterface
+	// Vnet is nil when an existing subnet is used
+	Vnet                 *network.VirtualNetwork
+	NetworkSecurityGroup *network.NetworkSecurityGroup
+	// PublicLbIp is nil for private clusters
+	PublicLbIp               *network.PublicIPAddress
+	PublicNatIps             []*network.PublicIPAddress
+	LoadBalancer             *network.LoadBalancer
+	ControlNetworkInterfaces []*network.NetworkInterface
+	// NetworkInterfacePublicIPs is empty for private clusters
 	NetworkInterfacePublicIPs []*network.PublicIPAddress
-	NatGateway                *network.NatGateway
+	// NatGateways and PublicNatIps hold one entry per availability zone, or a single one without zones
+	NatGateways []*network.NatGateway
+	// NodePoolInterfaces holds the NICs of every node pool, keyed by pool name and ordered by node index.
+	// Scale set pools have no entry, their instances get their NICs from the scale set.
+	NodePoolInterfaces map[string][]*network.NetworkInterface
+	// LbBackendPoolIds holds the control plane backend pool of each IP family, IPv4 first
+	LbBackendPoolIds []pulumi.StringPtrOutput
+	// OutboundPoolIdsV6 holds the backend pool every IPv6 address of a node joins for egress, empty unless the
+	// cluster is public and dual-stack
+	OutboundPoolIdsV6 []pulumi.StringPtrOutput
+	// ApiIp is the load balancer frontend IP, public or private depending on the network mode
+	ApiIp pulumi.StringPtrOutput
+	// ApiIpV6 is the IPv6 load balancer frontend IP of dual-stack clusters
+	ApiIpV6 pulumi.StringPtrOutput
+	// ControlPlaneEndpoints are the addresses talos clients connect to, ordered like ControlNetworkInterfaces
+	ControlPlaneEndpoints []pulumi.StringPtrOutput
+	VnetName              pulumi.StringOutput
+	// SubnetIds is keyed by node role and holds one subnet per availability zone, or a single one
+	// without zones. Both roles share the same subnet when an existing subnet is used.
+	SubnetIds map[string][]pulumi.StringPtrOutput
+	// DnsRecords are the records of the endpoint domain, empty unless a DNS zone is configured
+	DnsRecords []*network.RecordSet
 }
 
 type ProvisionNetworkingParams struct {
@@ -32,161 +54,102 @@ func ProvisionNetworking(ctx *pulumi.Context, params ProvisionNetworkingParams)
 		return NetworkResources{}, err
 	}
 
-	publicNatIp, err := network.NewPublicIPAddress(ctx, "public-nat-ip", &network.PublicIPAddressArgs{
-		PublicIPAllocationMethod: pulumi.String("static"),
-		ResourceGroupName:        params.ResourceGroup.Name,
-		Sku: network.PublicIPAddressSkuArgs{
-			Name: pulumi.String(network.PublicIPAddressSkuNameStandard),
-		},
-	})
-	if err != nil {
-		return NetworkResources{}, err
+	var vnetRes vnetResources
+	if conf.ExistingSubnet != nil {
+		vnetRes, err = lookupExistingSubnet(ctx, *conf.ExistingSubnet, conf.AddressSpace.DualStack)
+	} else {
+		vnetRes, err = provisionVnet(ctx, conf, params)
 	}
-
-	natGateway, err := network.NewNatGateway(ctx, "natGateway", &network.NatGatewayArgs{
-		PublicIpAddresses: network.SubResourceArray{
-			&network.SubResourceArgs{
-				Id: publicNatIp.ID(),
-			},
-		},
-		ResourceGroupName: params.ResourceGroup.Name,
-		Sku: &network.NatGatewaySkuArgs{
-			Name: pulumi.String(network.NatGatewaySkuNameStandard),
-		},
-	})
 	if err != nil {
 		return NetworkResources{}, err
 	}
 
-	var subnet = network.SubnetTypeArgs{
-		Name:          pulumi.String("subnet"),
-		AddressPrefix: pulumi.String("10.0.0.0/24"),
-		NatGateway: network.SubResourceArgs{
-			Id: natGateway.ID(),
-		},
+	// Rules are separate resources, so rules the cloud controller manager adds for Services are left alone
+	nsgArgs := &network.NetworkSecurityGroupArgs{
+		ResourceGroupName: params.ResourceGroup.Name,
 	}
-	subnet = *subnet.Defaults()
-	vnet, err := network.NewVirtualNetwork(ctx, "vnet", &network.VirtualNetworkArgs{
-		AddressSpace: &network.AddressSpaceArgs{
-			AddressPrefixes: pulumi.StringArray{
-				pulumi.String("10.0.0.0/16"),
-			},
-		},
-		FlowTimeoutInMinutes: pulumi.Int(10),
-		Location:             pulumi.String(conf.AzRegion),
-		ResourceGroupName:    params.ResourceGroup.Name,
-		VirtualNetworkName:   pulumi.String("vnet"),
-		Subnets:              network.SubnetTypeArray{subnet},
-	})
-	if err != nil {
-		return NetworkResources{}, err
+	nsgOpts := []pulumi.ResourceOption{pulumi.IgnoreChanges([]string{"securityRules"})}
+	if conf.RemoveInlineRules {
+		// Stacks deployed before rules were separate resources define apid, trustd, etcd and kube inline, which
+		// block the rule resources of the same name and priority. Explicitly setting no rules removes them before
+		// the rule resources are created.
+		nsgArgs.SecurityRules = network.SecurityRuleTypeArray{}
+		nsgOpts = nil
 	}
-
-	networkSecurityGroup, err := network.NewNetworkSecurityGroup(ctx, "nsg",
-		&network.NetworkSecurityGroupArgs{
-			ResourceGroupName: params.ResourceGroup.Name,
-			SecurityRules: network.SecurityRuleTypeArray{
-				makeSecurityRule(securityRuleParams{name: "apid", DestinationPortRange: "50000"}),
-				makeSecurityRule(securityRuleParams{name: "trustd", DestinationPortRange: "50001"}),
-				makeSecurityRule(securityRuleParams{name: "etcd", DestinationPortRange: "2379-2380"}),
-				makeSecurityRule(securityRuleParams{name: "kube", DestinationPortRange: "6443"}),
-			}},
-	)
+	networkSecurityGroup, err := network.NewNetworkSecurityGroup(ctx, "nsg", nsgArgs, nsgOpts...)
 	if err != nil {
 		return NetworkResources{}, err
 	}
-
-	publicLbIp, err := network.NewPublicIPAddress(ctx, "public-lb-ip", &network.PublicIPAddressArgs{
-		PublicIPAllocationMethod: pulumi.String("static"),
-		ResourceGroupName:        params.ResourceGroup.Name,
-		Sku: network.PublicIPAddressSkuArgs{
-			Name: pulumi.String(network.PublicIPAddressSkuNameStandard),
-		},
-	})
-	if err != nil {
-		return NetworkResources{}, err
+	for _, ruleParams := range makeSecurityRules(conf, vnetRes.subnetPrefixes, vnetRes.publicNatIps) {
+		rule := makeSecurityRule(ruleParams)
+		rule.ResourceGroupName = params.ResourceGroup.Name
+		rule.NetworkSecurityGroupName = networkSecurityGroup.Name
+		_, err = network.NewSecurityRule(ctx, fmt.Sprintf("nsg-rule-%s", ruleParams.name), &rule)
+		if err != nil {
+			return NetworkResources{}, err
+		}
 	}
 
-	lb, err := network.NewLoadBalancer(ctx, "lb", &network.LoadBalancerArgs{
-		FrontendIPConfigurations: network.FrontendIPConfigurationArray{
-			network.FrontendIPConfigurationArgs{
-				Name: pulumi.String("talos-fe"),
-				PublicIPAddress: network.PublicIPAddressTypeArgs{
-					IpAddress: publicLbIp.IpAddress,
-					Id:        publicLbIp.ID(),
-				},
-			},
-		},
-		Sku: network.LoadBalancerSkuArgs{
-			Name: pulumi.String(network.LoadBalancerSkuNameStandard),
-		},
-		BackendAddressPools: network.BackendAddressPoolArray{network.BackendAddressPoolArgs{
-			Name: pulumi.String("talos-be-pool"),
-		}},
-		ResourceGroupName: params.ResourceGroup.Name,
-		Probes: network.ProbeArray{network.ProbeArgs{
-			Name:     pulumi.String("talos-lb-health"),
-			Port:     pulumi.Int(6443),
-			Protocol: pulumi.String("TCP"),
-		}},
-	})
+	lbRes, err := provisionLoadBalancer(ctx, conf, params, vnetRes)
 	if err != nil {
 		return NetworkResources{}, err
 	}
-
-	lbRule, err := network.NewInboundNatRule(ctx, "talos-6443", &network.InboundNatRuleArgs{
-		ResourceGroupName: params.ResourceGroup.Name,
-		Protocol:          pulumi.String("TCP"),
-		FrontendIPConfiguration: network.SubResourceArgs{
-			Id: lb.FrontendIPConfigurations.Index(pulumi.Int(0)).Id(),
-		},
-		BackendAddressPool: network.SubResourceArgs{
-			Id: lb.BackendAddressPools.Index(pulumi.Int(0)).Id(),
-		},
-		FrontendPortRangeStart: pulumi.Int(6443),
-		FrontendPortRangeEnd:   pulumi.Int(6443),
-		BackendPort:            pulumi.Int(6443),
-		LoadBalancerName:       lb.Name,
-	})
+	dnsRecords, err := provisionDnsRecords(ctx, conf, lbRes)
 	if err != nil {
 		return NetworkResources{}, err
 	}
-
-	lbBeAddressPool := lb.BackendAddressPools.Index(pulumi.Int(0)).Id()
-	nicPubIps := make([]*network.PublicIPAddress, conf.ControlCount)
-	controlPlaneNics := make([]*network.NetworkInterface, conf.ControlCount)
-	workerNics := make([]*network.NetworkInterface, conf.WorkerCount)
-	for i := 0; i < conf.ControlCount; i++ {
-		nicPubIp, err := network.NewPublicIPAddress(ctx, fmt.Sprintf("controlplane-public-ip-%d", i),
-			&network.PublicIPAddressArgs{
-				ResourceGroupName:        params.ResourceGroup.Name,
-				PublicIPAllocationMethod: pulumi.String("static"),
-				Sku: network.PublicIPAddressSkuArgs{
-					Name: pulumi.String(network.PublicIPAddressSkuNameStandard),
-				},
-			})
-		if err != nil {
-			return NetworkResources{}, err
-		}
-		nicPubIps[i] = nicPubIp
-
-		nicName := fmt.Sprintf("controlplane-nic-%d", i)
-		nic, err := createNic(ctx, nicName, params, networkSecurityGroup, nicPubIp, vnet, lbBeAddressPool)
-		if err != nil {
-			return NetworkResources{}, err
+	nicPubIps := make([]*network.PublicIPAddress, 0)
+	controlPlaneEndpoints := make([]pulumi.StringPtrOutput, 0)
+	controlPlaneNics := make([]*network.NetworkInterface, 0)
+	poolNics := make(map[string][]*network.NetworkInterface, len(conf.NodePools))
+	for _, pool := range conf.NodePools {
+		if pool.ScaleSet {
+			continue
 		}
-		controlPlaneNics[i] = nic
-	}
-	for i := 0; i < conf.WorkerCount; i++ {
-		nicName := fmt.Sprintf("worker-nic-%d", i)
-		nic, err := createNic(ctx, nicName, params, networkSecurityGroup, nil, vnet, lbBeAddressPool)
-		if err != nil {
-			return NetworkResources{}, err
+		nics := make([]*network.NetworkInterface, pool.Count)
+		for i := 0; i < pool.Count; i++ {
+			var nicPubIp *network.PublicIPAddress
+			if pool.IsControlplane() && !conf.IsPrivate() {
+				nicPubIp, err = newPublicIp(ctx, fmt.Sprintf("%s-public-ip-%d", pool.NetworkPrefix(), i), params, conf.Zones, network.IPVersionIPv4)
+				if err != nil {
+					return NetworkResources{}, err
+				}
+				nicPubIps = append(nicPubIps, nicPubIp)
+			}
+
+			nicName := fmt.Sprintf("%s-nic-%d", pool.NetworkPrefix(), i)
+			// Nodes are spread round-robin across zones, matching the zone the VM is placed in
+			roleSubnetIds := vnetRes.subnetIds[pool.Role]
+			subnetId := roleSubnetIds[i%len(roleSubnetIds)]
+			// Only control plane nodes are load balanced, worker NICs only join the IPv6 outbound pool
+			var backendPoolIds, backendPoolIdsV6 []pulumi.StringPtrOutput
+			if pool.IsControlplane() {
+				backendPoolIds = lbRes.backendPoolIds[:1]
+				backendPoolIdsV6 = append(backendPoolIdsV6, lbRes.backendPoolIds[1:]...)
+			}
+			backendPoolIdsV6 = append(backendPoolIdsV6, lbRes.outboundPoolIdsV6...)
+			nic, err := createNic(ctx, nicName, params, networkSecurityGroup, nicPubIp, subnetId, backendPoolIds, backendPoolIdsV6, conf.AddressSpace.DualStack)
+			if err != nil {
+				return NetworkResources{}, err
+			}
+			nics[i] = nic
+			if pool.IsControlplane() {
+				controlPlaneNics = append(controlPlaneNics, nic)
+				if nicPubIp != nil {
+					controlPlaneEndpoints = append(controlPlaneEndpoints, nicPubIp.IpAddress)
+				} else {
+					controlPlaneEndpoints = append(controlPlaneEndpoints, nic.IpConfigurations.Index(pulumi.Int(0)).PrivateIPAddress())
+				}
+			}
 		}
-		workerNics[i] = nic
+		poolNics[pool.Name] = nics
 	}
 
-	return NetworkResources{vnet, networkSecurityGroup, publicLbIp, publicNatIp, lb, lbRule, controlPlaneNics, workerNics, nicPubIps, natGateway}, nil
+	return NetworkResources{
+		vnetRes.vnet, networkSecurityGroup, lbRes.publicLbIp, vnetRes.publicNatIps, lbRes.lb, controlPlaneNics, nicPubIps,
+		vnetRes.natGateways, poolNics, lbRes.backendPoolIds, lbRes.outboundPoolIdsV6, lbRes.apiIp, lbRes.apiIpV6, controlPlaneEndpoints, vnetRes.vnetName,
+		vnetRes.subnetIds, dnsRecords,
+	}, nil
 }
 
 func createNic(
@@ -195,13 +158,32 @@ func createNic(
 	params ProvisionNetworkingParams,
 	networkSecurityGroup *network.NetworkSecurityGroup,
 	nicPubIp *network.PublicIPAddress,
-	vnet *network.VirtualNetwork,
-	lbBEAddressPoolID pulumi.StringPtrOutput,
+	subnetId pulumi.StringPtrOutput,
+	lbBackendPoolIds []pulumi.StringPtrOutput,
+	lbBackendPoolIdsV6 []pulumi.StringPtrOutput,
+	dualStack bool,
 ) (*network.NetworkInterface, error) {
 	var pubIp *network.PublicIPAddressTypeArgs
 	if nicPubIp != nil {
 		pubIp = &network.PublicIPAddressTypeArgs{Id: nicPubIp.ID()}
 	}
+	ipConfigs := network.NetworkInterfaceIPConfigurationArray{network.NetworkInterfaceIPConfigurationArgs{
+		Name:                            pulumi.String(fmt.Sprintf("%s-ip-conf", nicName)),
+		Primary:                         pulumi.Bool(true),
+		PublicIPAddress:                 pubIp,
+		Subnet:                          network.SubnetTypeArgs{Id: subnetId},
+		LoadBalancerBackendAddressPools: backendPoolsInput(lbBackendPoolIds),
+	}}
+	// The IPv6 address is a secondary IP configuration, the primary one has to be IPv4
+	if dualStack {
+		ipConfigs = append(ipConfigs, network.NetworkInterfaceIPConfigurationArgs{
+			Name:                            pulumi.String(fmt.Sprintf("%s-ip-conf-v6", nicName)),
+			Primary:                         pulumi.Bool(false),
+			PrivateIPAddressVersion:         pulumi.String(network.IPVersionIPv6),
+			Subnet:                          network.SubnetTypeArgs{Id: subnetId},
+			LoadBalancerBackendAddressPools: backendPoolsInput(lbBackendPoolIdsV6),
+		})
+	}
 	return network.NewNetworkInterface(ctx, nicName,
 		&network.NetworkInterfaceArgs{
 			ResourceGroupName:    params.ResourceGroup.Name,
@@ -209,13 +191,18 @@ func createNic(
 			NetworkSecurityGroup: network.NetworkSecurityGroupTypeArgs{
 				Id: networkSecurityGroup.ID(),
 			},
-			IpConfigurations: network.NetworkInterfaceIPConfigurationArray{network.NetworkInterfaceIPConfigurationArgs{
-				Name:            pulumi.String(fmt.Sprintf("%s-ip-conf", nicName)),
-				PublicIPAddress: pubIp,
-				Subnet:          network.SubnetTypeArgs{Id: vnet.Subnets.Index(pulumi.Int(0)).Id()},
-				LoadBalancerBackendAddressPools: network.BackendAddressPoolArray{network.BackendAddressPoolArgs{
-					Id: lbBEAddressPoolID,
-				}},
-			}},
+			IpConfigurations: ipConfigs,
 		})
 }
+
+// backendPoolsInput references the given backend pools, or is nil for IP configurations which aren't in any
+func backendPoolsInput(backendPoolIds []pulumi.StringPtrOutput) network.BackendAddressPoolArrayInput {
+	if len(backendPoolIds) == 0 {
+		return nil
+	}
+	pools := make(network.BackendAddressPoolArray, len(backendPoolIds))
+	for i, id := range backendPoolIds {
+		pools[i] = network.BackendAddressPoolArgs{Id: id}
+	}
+	return pools
+}
@@ -0,0 +1,164 @@
+package network
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"talos-azure/helpers"
+
+	"github.com/pulumi/pulumi-azure-native-sdk/network/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+type vnetResources struct {
+	vnet     *network.VirtualNetwork
+	vnetName pulumi.StringOutput
+	// subnetIds is keyed by node role and holds one subnet per zone
+	subnetIds      map[string][]pulumi.StringPtrOutput
+	subnetPrefixes []string
+	publicNatIps   []*network.PublicIPAddress
+	natGateways    []*network.NatGateway
+}
+
+func provisionVnet(ctx *pulumi.Context, conf helpers.CustomConfig, params ProvisionNetworkingParams) (vnetResources, error) {
+	// Without zones there is a single subnet per role and NAT gateway, otherwise one of each per zone
+	// since a NAT gateway is a zonal resource.
+	zones := conf.Zones
+	if len(zones) == 0 {
+		zones = []string{""}
+	}
+	publicNatIps := make([]*network.PublicIPAddress, len(zones))
+	natGateways := make([]*network.NatGateway, len(zones))
+	roles := []string{helpers.RoleControlplane, helpers.RoleWorker}
+	subnets := make(network.SubnetTypeArray, 0)
+	subnetPrefixes := make([]string, 0)
+	for i, zone := range zones {
+		suffix := ""
+		var zoneList []string
+		if zone != "" {
+			suffix = "-zone-" + zone
+			zoneList = []string{zone}
+		}
+
+		publicNatIp, err := newPublicIp(ctx, "public-nat-ip"+suffix, params, zoneList, network.IPVersionIPv4)
+		if err != nil {
+			return vnetResources{}, err
+		}
+		publicNatIps[i] = publicNatIp
+
+		natGateway, err := network.NewNatGateway(ctx, "natGateway"+suffix, &network.NatGatewayArgs{
+			PublicIpAddresses: network.SubResourceArray{
+				&network.SubResourceArgs{
+					Id: publicNatIp.ID(),
+				},
+			},
+			ResourceGroupName: params.ResourceGroup.Name,
+			Sku: &network.NatGatewaySkuArgs{
+				Name: pulumi.String(network.NatGatewaySkuNameStandard),
+			},
+			Zones: zonesInput(zoneList),
+		})
+		if err != nil {
+			return vnetResources{}, err
+		}
+		natGateways[i] = natGateway
+
+		for _, role := range roles {
+			prefix := conf.AddressSpace.RoleSubnets(role)[i]
+			subnetPrefixes = append(subnetPrefixes, prefix)
+			var subnet = network.SubnetTypeArgs{
+				Name: pulumi.String(fmt.Sprintf("%s-subnet%s", role, suffix)),
+				NatGateway: network.SubResourceArgs{
+					Id: natGateway.ID(),
+				},
+			}
+			// The NAT gateway only handles IPv4, IPv6 egresses through the outbound rule of the public load balancer
+			if conf.AddressSpace.DualStack {
+				prefixV6 := conf.AddressSpace.RoleSubnetsV6(role)[i]
+				subnetPrefixes = append(subnetPrefixes, prefixV6)
+				subnet.AddressPrefixes = pulumi.StringArray{pulumi.String(prefix), pulumi.String(prefixV6)}
+			} else {
+				subnet.AddressPrefix = pulumi.String(prefix)
+			}
+			subnets = append(subnets, *subnet.Defaults())
+		}
+	}
+
+	vnetPrefixes := pulumi.StringArray{pulumi.String(conf.AddressSpace.VnetCidr)}
+	if conf.AddressSpace.DualStack {
+		vnetPrefixes = append(vnetPrefixes, pulumi.String(conf.AddressSpace.VnetCidrV6))
+	}
+	vnet, err := network.NewVirtualNetwork(ctx, "vnet", &network.VirtualNetworkArgs{
+		AddressSpace: &network.AddressSpaceArgs{
+			AddressPrefixes: vnetPrefixes,
+		},
+		FlowTimeoutInMinutes: pulumi.Int(10),
+		Location:             pulumi.String(conf.AzRegion),
+		ResourceGroupName:    params.ResourceGroup.Name,
+		VirtualNetworkName:   pulumi.String("vnet"),
+		Subnets:              subnets,
+	})
+	if err != nil {
+		return vnetResources{}, err
+	}
+
+	// Subnets are ordered by zone, then role
+	subnetIds := make(map[string][]pulumi.StringPtrOutput, len(roles))
+	for i := range zones {
+		for j, role := range roles {
+			subnetIds[role] = append(subnetIds[role], vnet.Subnets.Index(pulumi.Int(i*len(roles)+j)).Id())
+		}
+	}
+
+	return vnetResources{vnet, vnet.Name, subnetIds, subnetPrefixes, publicNatIps, natGateways}, nil
+}
+
+// lookupExistingSubnet references a subnet managed outside of the stack. Neither a VNet nor NAT gateways
+// are created, outbound connectivity is up to the owner of the network.
+func lookupExistingSubnet(ctx *pulumi.Context, ref helpers.SubnetRef, dualStack bool) (vnetResources, error) {
+	subnet, err := network.LookupSubnet(ctx, &network.LookupSubnetArgs{
+		ResourceGroupName:  ref.ResourceGroupName,
+		VirtualNetworkName: ref.VirtualNetworkName,
+		SubnetName:         ref.SubnetName,
+	})
+	if err != nil {
+		return vnetResources{}, fmt.Errorf("failed to look up existing subnet %s: %w", ref.Id, err)
+	}
+
+	// The lookup uses the subscription of the provider, which may have a subnet of the same name
+	if subscriptionId := subscriptionOf(*subnet.Id); !strings.EqualFold(subscriptionId, ref.SubscriptionId) {
+		return vnetResources{}, fmt.Errorf("existing subnet %s is in subscription %s, but the stack deploys to subscription %s",
+			ref.Id, ref.SubscriptionId, subscriptionId)
+	}
+
+	prefixes := subnet.AddressPrefixes
+	if subnet.AddressPrefix != nil {
+		prefixes = append(prefixes, *subnet.AddressPrefix)
+	}
+	if len(prefixes) == 0 {
+		return vnetResources{}, fmt.Errorf("existing subnet %s has no address prefix", ref.Id)
+	}
+	if dualStack && !slices.ContainsFunc(prefixes, func(prefix string) bool { return strings.Contains(prefix, ":") }) {
+		return vnetResources{}, fmt.Errorf("existing subnet %s has no IPv6 address prefix, which dual-stack requires", ref.Id)
+	}
+
+	// Both roles share the existing subnet
+	subnetId := pulumi.StringPtr(*subnet.Id).ToStringPtrOutput()
+	return vnetResources{
+		vnetName: pulumi.String(ref.VirtualNetworkName).ToStringOutput(),
+		subnetIds: map[string][]pulumi.StringPtrOutput{
+			helpers.RoleControlplane: {subnetId},
+			helpers.RoleWorker:       {subnetId},
+		},
+		subnetPrefixes: prefixes,
+	}, nil
+}
+
+// subscriptionOf returns the subscription of an Azure resource ID
+func subscriptionOf(id string) string {
+	parts := strings.Split(strings.Trim(id, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
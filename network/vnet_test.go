@@ -0,0 +1,81 @@
+package network
+
+import (
+	"slices"
+	"talos-azure/helpers"
+	"talos-azure/internal/testutil"
+	"testing"
+
+	"github.com/pulumi/pulumi-azure-native-sdk/resources/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+func TestProvisionVnet(t *testing.T) {
+	space := helpers.AddressSpace{
+		VnetCidr:            "10.0.0.0/16",
+		ControlplaneSubnets: []string{"10.0.0.0/24", "10.0.2.0/24"},
+		WorkerSubnets:       []string{"10.0.1.0/24", "10.0.3.0/24"},
+	}
+	dualStack := space
+	dualStack.DualStack = true
+	dualStack.VnetCidrV6 = "fd00:10::/48"
+	dualStack.ControlplaneSubnetsV6 = []string{"fd00:10::/64", "fd00:10:0:2::/64"}
+	dualStack.WorkerSubnetsV6 = []string{"fd00:10:0:1::/64", "fd00:10:0:3::/64"}
+
+	tests := []struct {
+		name         string
+		zones        []string
+		space        helpers.AddressSpace
+		wantPrefixes []string
+	}{
+		{"no zones", nil, space, []string{"10.0.0.0/24", "10.0.1.0/24"}},
+		{"zones", []string{"1", "2"}, space, []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"}},
+		{"dual-stack", nil, dualStack, []string{"10.0.0.0/24", "fd00:10::/64", "10.0.1.0/24", "fd00:10:0:1::/64"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testutil.WithConfig(t, nil, func(ctx *pulumi.Context) error {
+				resourceGroup, err := resources.NewResourceGroup(ctx, "rg", nil)
+				if err != nil {
+					return err
+				}
+				conf := helpers.CustomConfig{AzRegion: "westeurope", Zones: tt.zones, AddressSpace: tt.space}
+				res, err := provisionVnet(ctx, conf, ProvisionNetworkingParams{ResourceGroup: resourceGroup})
+				if err != nil {
+					return err
+				}
+
+				if !slices.Equal(res.subnetPrefixes, tt.wantPrefixes) {
+					t.Errorf("subnetPrefixes = %v, want %v", res.subnetPrefixes, tt.wantPrefixes)
+				}
+				zoneCount := max(len(tt.zones), 1)
+				for _, role := range []string{helpers.RoleControlplane, helpers.RoleWorker} {
+					if len(res.subnetIds[role]) != zoneCount {
+						t.Errorf("got %d %s subnets, want one per zone", len(res.subnetIds[role]), role)
+					}
+				}
+				if len(res.natGateways) != zoneCount || len(res.publicNatIps) != zoneCount {
+					t.Errorf("got %d NAT gateways and %d IPs, want one per zone", len(res.natGateways), len(res.publicNatIps))
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestSubscriptionOf(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/nodes", "sub"},
+		{"subscriptions/sub", "sub"},
+		{"/subscriptions", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := subscriptionOf(tt.id); got != tt.want {
+			t.Errorf("subscriptionOf(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
@@ -3,5 +3,3 @@ talosctl --talosconfig secrets/talosconfig config endpoint \
 
 talosctl --talosconfig secrets/talosconfig config node \
   `pulumi stack output --json | jq -r '.NetworkInterfaces[0].ip'`
-
-talosctl --talosconfig secrets/talosconfig bootstrap
\ No newline at end of file
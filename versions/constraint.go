@@ -0,0 +1,120 @@
+package versions
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a release version, pre-releases aren't supported
+type Version struct {
+	Major, Minor, Patch int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+func (v Version) less(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Patch < other.Patch
+}
+
+// ParseVersion parses versions in the form 1.7.6, optionally prefixed with v
+func ParseVersion(s string) (Version, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) != 3 {
+		return Version{}, fmt.Errorf("%q is not a version in the form major.minor.patch", s)
+	}
+	numbers, err := parseNumbers(parts)
+	if err != nil {
+		return Version{}, fmt.Errorf("%q is not a version in the form major.minor.patch", s)
+	}
+	return Version{numbers[0], numbers[1], numbers[2]}, nil
+}
+
+// Constraint selects versions within [min, max), max is exclusive and unbounded when zero
+type Constraint struct {
+	min, max Version
+	// exact is set for constraints only matching a single version
+	exact bool
+}
+
+// ParseConstraint parses latest, exact versions such as 1.7.6, ~1.7 or ~1.7.2 for patch releases and ^1.7 or
+// ^1.7.2 for minor and patch releases
+func ParseConstraint(s string) (Constraint, error) {
+	if s == "latest" {
+		return Constraint{}, nil
+	}
+	if version, err := ParseVersion(s); err == nil {
+		return Constraint{min: version, exact: true}, nil
+	}
+
+	invalid := fmt.Errorf("%q is neither latest, a version such as 1.7.6 nor a constraint such as ~1.7 or ^1.7", s)
+	if len(s) < 2 || (s[0] != '~' && s[0] != '^') {
+		return Constraint{}, invalid
+	}
+	operator, parts := s[0], strings.Split(s[1:], ".")
+	numbers, err := parseNumbers(parts)
+	if err != nil || len(parts) > 3 || (operator == '~' && len(parts) < 2) {
+		return Constraint{}, invalid
+	}
+	for len(numbers) < 3 {
+		numbers = append(numbers, 0)
+	}
+
+	lower := Version{numbers[0], numbers[1], numbers[2]}
+	if operator == '~' {
+		return Constraint{min: lower, max: Version{lower.Major, lower.Minor + 1, 0}}, nil
+	}
+	return Constraint{min: lower, max: Version{lower.Major + 1, 0, 0}}, nil
+}
+
+// Exact reports whether the constraint is a single version, which doesn't need to be resolved
+func (c Constraint) Exact() (Version, bool) {
+	return c.min, c.exact
+}
+
+func (c Constraint) Matches(v Version) bool {
+	if c.exact {
+		return v == c.min
+	}
+	if v.less(c.min) {
+		return false
+	}
+	return c.max == (Version{}) || v.less(c.max)
+}
+
+// Latest returns the highest of the given versions matching the constraint, unparsable versions such as
+// pre-releases are skipped
+func (c Constraint) Latest(candidates []string) (Version, bool) {
+	var latest Version
+	found := false
+	for _, candidate := range candidates {
+		version, err := ParseVersion(candidate)
+		if err != nil || !c.Matches(version) {
+			continue
+		}
+		if !found || latest.less(version) {
+			latest, found = version, true
+		}
+	}
+	return latest, found
+}
+
+func parseNumbers(parts []string) ([]int, error) {
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 || strings.HasPrefix(part, "+") {
+			return nil, fmt.Errorf("%q is not a version number", part)
+		}
+		numbers[i] = number
+	}
+	return numbers, nil
+}
@@ -0,0 +1,105 @@
+package versions
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    Version
+		wantErr bool
+	}{
+		{"1.7.6", Version{1, 7, 6}, false},
+		{"v1.8.0", Version{1, 8, 0}, false},
+		{"1.7", Version{}, true},
+		{"1.8.0-alpha.1", Version{}, true},
+		{"1.7.-1", Version{}, true},
+		{"1.7.+1", Version{}, true},
+		{"latest", Version{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := ParseVersion(tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseVersion(%q) error = %v, wantErr %v", tt.version, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseVersion(%q) = %v, want %v", tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	available := []string{"v1.6.7", "v1.7.0", "v1.7.2", "v1.7.6", "v1.8.0-alpha.1", "v1.8.0-beta.0", "v1.8.1", "v2.0.0-alpha.0", "invalid"}
+
+	tests := []struct {
+		constraint string
+		matches    []string
+		rejects    []string
+		latest     string
+		exact      bool
+	}{
+		{"latest", []string{"0.1.0", "1.7.6", "2.0.0"}, nil, "1.8.1", false},
+		{"1.7.2", []string{"1.7.2"}, []string{"1.7.1", "1.7.3"}, "1.7.2", true},
+		{"v1.7.2", []string{"1.7.2"}, []string{"1.7.6"}, "1.7.2", true},
+		{"~1.7", []string{"1.7.0", "1.7.99"}, []string{"1.6.7", "1.8.0"}, "1.7.6", false},
+		{"~1.7.2", []string{"1.7.2", "1.7.6"}, []string{"1.7.1", "1.8.0"}, "1.7.6", false},
+		{"^1.7", []string{"1.7.0", "1.8.1", "1.99.0"}, []string{"1.6.7", "2.0.0"}, "1.8.1", false},
+		{"^1.7.2", []string{"1.7.2", "1.8.0"}, []string{"1.7.1", "2.0.0"}, "1.8.1", false},
+		{"^1", []string{"1.0.0", "1.8.1"}, []string{"0.9.0", "2.0.0"}, "1.8.1", false},
+		{"~1.9", []string{"1.9.0"}, []string{"1.8.1"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint, func(t *testing.T) {
+			constraint, err := ParseConstraint(tt.constraint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, exact := constraint.Exact(); exact != tt.exact {
+				t.Errorf("Exact() = %v, want %v", exact, tt.exact)
+			}
+			for _, version := range tt.matches {
+				if !constraint.Matches(mustParse(t, version)) {
+					t.Errorf("%s doesn't match %s", tt.constraint, version)
+				}
+			}
+			for _, version := range tt.rejects {
+				if constraint.Matches(mustParse(t, version)) {
+					t.Errorf("%s matches %s", tt.constraint, version)
+				}
+			}
+
+			// Pre-releases and unparsable versions are skipped
+			latest, found := constraint.Latest(available)
+			if found != (tt.latest != "") {
+				t.Fatalf("Latest() found = %v, want %v", found, tt.latest != "")
+			}
+			if found && latest.String() != tt.latest {
+				t.Errorf("Latest() = %s, want %s", latest, tt.latest)
+			}
+		})
+	}
+}
+
+func TestParseConstraintErrors(t *testing.T) {
+	for _, constraint := range []string{"", "~", "~1", "^", "^1.7.2.1", ">=1.7", "~1.x", "1.8.0-alpha.1", "^-1"} {
+		t.Run(constraint, func(t *testing.T) {
+			_, err := ParseConstraint(constraint)
+			if err == nil || !strings.Contains(err.Error(), "is neither latest, a version such as 1.7.6 nor a constraint") {
+				t.Errorf("ParseConstraint(%q) error = %v", constraint, err)
+			}
+		})
+	}
+}
+
+func mustParse(t *testing.T, version string) Version {
+	t.Helper()
+	parsed, err := ParseVersion(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
@@ -0,0 +1,71 @@
+package versions
+
+import (
+	"fmt"
+	"talos-azure/helpers"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const kubernetesVersionOutput = "kubernetesVersion"
+
+// KubernetesVersion is cluster:kubernetesVersion along with the version of the last update
+type KubernetesVersion struct {
+	// Version is empty when the version is left to the Talos default
+	Version string
+	// Previous is empty on the first update or when the version was left to the Talos default
+	Previous string
+	// deployed is set when the cluster existed before this update
+	deployed bool
+}
+
+// Upgrade returns the version the cluster has to be upgraded to, empty when the nodes already got it from their
+// machine config. Clusters running the Talos default are upgraded once cluster:kubernetesVersion is set.
+func (v KubernetesVersion) Upgrade() string {
+	if v.Version == "" || v.Version == v.Previous || !v.deployed {
+		return ""
+	}
+	return v.Version
+}
+
+// Deployed returns the version the nodes run before this update, empty for the Talos default. Machine configs keep
+// it until UpgradeKubernetes rolled out the new version, which the next update then puts into the configs.
+func (v KubernetesVersion) Deployed() string {
+	if v.Upgrade() != "" {
+		return v.Previous
+	}
+	return v.Version
+}
+
+// ResolveKubernetesVersion compares cluster:kubernetesVersion with the version of the last update, which is
+// kept in the outputs of the stack. The Talos version has to be resolved first, it tells whether the cluster
+// was deployed before and references the stack.
+func ResolveKubernetesVersion(ctx *pulumi.Context, talosVersion TalosVersion) (KubernetesVersion, error) {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return KubernetesVersion{}, err
+	}
+	previous, err := previousOutputs(talosVersion.stack, kubernetesVersionOutput)
+	if err != nil {
+		return KubernetesVersion{}, err
+	}
+	resolved := KubernetesVersion{Version: conf.KubernetesVersion, Previous: previous[0], deployed: talosVersion.Previous != ""}
+
+	if resolved.Version != "" {
+		ctx.Export(kubernetesVersionOutput, pulumi.String(resolved.Version))
+	}
+	if upgrade := resolved.Upgrade(); upgrade != "" {
+		from := resolved.Previous
+		if from == "" {
+			from = "the Talos default"
+		}
+		err = ctx.Log.Warn(fmt.Sprintf(
+			"Kubernetes version changes from %s to %s, control plane components and kubelets will be upgraded in place",
+			from, upgrade,
+		), nil)
+		if err != nil {
+			return KubernetesVersion{}, err
+		}
+	}
+	return resolved, nil
+}
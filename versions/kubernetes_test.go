@@ -0,0 +1,28 @@
+package versions
+
+import "testing"
+
+func TestKubernetesVersion(t *testing.T) {
+	tests := []struct {
+		name         string
+		version      KubernetesVersion
+		wantUpgrade  string
+		wantDeployed string
+	}{
+		{"first update", KubernetesVersion{Version: "1.30.3"}, "", "1.30.3"},
+		{"Talos default", KubernetesVersion{deployed: true}, "", ""},
+		{"unchanged", KubernetesVersion{Version: "1.30.3", Previous: "1.30.3", deployed: true}, "", "1.30.3"},
+		{"upgrade", KubernetesVersion{Version: "1.31.0", Previous: "1.30.3", deployed: true}, "1.31.0", "1.30.3"},
+		{"pinned after the Talos default", KubernetesVersion{Version: "1.31.0", deployed: true}, "1.31.0", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.version.Upgrade(); got != tt.wantUpgrade {
+				t.Errorf("Upgrade() = %q, want %q", got, tt.wantUpgrade)
+			}
+			if got := tt.version.Deployed(); got != tt.wantDeployed {
+				t.Errorf("Deployed() = %q, want %q", got, tt.wantDeployed)
+			}
+		})
+	}
+}
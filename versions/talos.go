@@ -0,0 +1,165 @@
+package versions
+
+import (
+	"fmt"
+	"strings"
+	"talos-azure/helpers"
+	"talos-azure/imagefactory"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// The resolved version is kept in the outputs of the stack and read back on the next run
+const (
+	talosVersionOutput           = "talosVersion"
+	talosVersionConstraintOutput = "talosVersionConstraint"
+)
+
+// TalosVersion is cluster:talos-version resolved to a version
+type TalosVersion struct {
+	Constraint string
+	Version    string
+	// Previous is the version of the last update, empty on the first one
+	Previous string
+	// stack references the stack itself to read the outputs of the last update, it can only be created once per run
+	stack *pulumi.StackReference
+}
+
+func (v TalosVersion) Changed() bool {
+	return v.Previous != "" && v.Previous != v.Version
+}
+
+// Deployed returns the version the nodes run before this update, which is the resolved version on the first one.
+// Machine configs are generated for its contract, as they are applied before the nodes are upgraded.
+func (v TalosVersion) Deployed() string {
+	if v.Previous != "" {
+		return v.Previous
+	}
+	return v.Version
+}
+
+// ResolveTalosVersion resolves cluster:talos-version, everything depending on the version gets the result passed.
+// Versions are resolved against the Image Factory once, later runs keep the version of the previous update until
+// the constraint is changed.
+func ResolveTalosVersion(ctx *pulumi.Context) (TalosVersion, error) {
+	clusterCfg := config.New(ctx, "cluster")
+	constraint := clusterCfg.Require("talos-version")
+	parsed, err := ParseConstraint(constraint)
+	if err != nil {
+		return TalosVersion{}, fmt.Errorf("cluster:talos-version config is invalid, %w", err)
+	}
+
+	stack, err := newSelfReference(ctx)
+	if err != nil {
+		return TalosVersion{}, err
+	}
+	previous, previousConstraint, err := previousTalosVersion(stack)
+	if err != nil {
+		return TalosVersion{}, err
+	}
+	resolved := TalosVersion{Constraint: constraint, Previous: previous, stack: stack}
+
+	if version, ok := parsed.Exact(); ok {
+		resolved.Version = version.String()
+	} else if previousVersion, err := ParseVersion(previous); err == nil && previousConstraint == constraint && parsed.Matches(previousVersion) {
+		resolved.Version = previous
+	} else {
+		resolved.Version, err = latestTalosVersion(ctx, clusterCfg, parsed)
+		if err != nil {
+			return TalosVersion{}, err
+		}
+	}
+
+	ctx.Export(talosVersionOutput, pulumi.String(resolved.Version))
+	ctx.Export(talosVersionConstraintOutput, pulumi.String(constraint))
+
+	if resolved.Changed() {
+		err = logVersionChange(ctx, resolved)
+		if err != nil {
+			return TalosVersion{}, err
+		}
+	}
+	return resolved, nil
+}
+
+// previousTalosVersion reads the version and constraint of the last update from the outputs of the stack itself
+func previousTalosVersion(stack *pulumi.StackReference) (string, string, error) {
+	outputs, err := previousOutputs(stack, talosVersionOutput, talosVersionConstraintOutput)
+	if err != nil {
+		return "", "", err
+	}
+	return outputs[0], outputs[1], nil
+}
+
+// newSelfReference references the stack itself by its fully qualified name. Pulumi Cloud and DIY backends with
+// project scoped stacks, the default since Pulumi 3.61 where the organization is always "organization", resolve
+// it. Legacy DIY backends without projects don't and have to be upgraded with pulumi state upgrade first.
+func newSelfReference(ctx *pulumi.Context) (*pulumi.StackReference, error) {
+	stackName := fmt.Sprintf("%s/%s/%s", ctx.Organization(), ctx.Project(), ctx.Stack())
+	return pulumi.NewStackReference(ctx, stackName, nil)
+}
+
+// previousOutputs reads string outputs of the last update, missing outputs are empty
+func previousOutputs(stack *pulumi.StackReference, names ...string) ([]string, error) {
+	outputs := make([]string, len(names))
+	for i, name := range names {
+		details, err := stack.GetOutputDetails(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read output %s of the stack: %w", name, err)
+		}
+		outputs[i], _ = details.Value.(string)
+	}
+	return outputs, nil
+}
+
+// latestTalosVersion picks the newest version matching the constraint from the versions the Image Factory knows
+func latestTalosVersion(ctx *pulumi.Context, clusterCfg *config.Config, constraint Constraint) (string, error) {
+	factoryUrl := helpers.DefaultFactoryUrl
+	var schematic helpers.Schematic
+	if err := clusterCfg.GetObject("schematic", &schematic); err == nil && schematic.FactoryUrl != "" {
+		factoryUrl = schematic.FactoryUrl
+	}
+
+	client, err := imagefactory.NewClient(factoryUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	available, err := client.Versions(ctx.Context())
+	if err != nil {
+		return "", err
+	}
+	latest, ok := constraint.Latest(available)
+	if !ok {
+		return "", fmt.Errorf("no Talos version available at %s matches cluster:talos-version", factoryUrl)
+	}
+	return latest.String(), nil
+}
+
+// logVersionChange shows which nodes get upgraded, so the change is visible in the preview
+func logVersionChange(ctx *pulumi.Context, version TalosVersion) error {
+	conf, err := helpers.GetConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	var nodes, scaleSets []string
+	for _, pool := range conf.NodePools {
+		if pool.ScaleSet {
+			scaleSets = append(scaleSets, pool.Name)
+			continue
+		}
+		for i := 0; i < pool.Count; i++ {
+			nodes = append(nodes, pool.NodeName(i))
+		}
+	}
+	message := fmt.Sprintf(
+		"Talos version changes from %s to %s (cluster:talos-version %s), the following nodes will be upgraded in place, "+
+			"one control plane node at a time and workers in batches of %d: %s",
+		version.Previous, version.Version, version.Constraint, conf.Upgrade.WorkerBatchSize, strings.Join(nodes, ", "),
+	)
+	if len(scaleSets) > 0 {
+		message += fmt.Sprintf(", along with the instances of scale sets %s that joined the cluster", strings.Join(scaleSets, ", "))
+	}
+	return ctx.Log.Warn(message, nil)
+}
@@ -0,0 +1,22 @@
+package versions
+
+import "testing"
+
+func TestTalosVersionDeployed(t *testing.T) {
+	tests := []struct {
+		name    string
+		version TalosVersion
+		want    string
+	}{
+		{"first update", TalosVersion{Version: "1.7.6"}, "1.7.6"},
+		{"unchanged", TalosVersion{Version: "1.7.6", Previous: "1.7.6"}, "1.7.6"},
+		{"upgrade", TalosVersion{Version: "1.8.0", Previous: "1.7.6"}, "1.7.6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.version.Deployed(); got != tt.want {
+				t.Errorf("Deployed() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}